@@ -0,0 +1,324 @@
+package main
+
+import (
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+var (
+	aggregatedPointsCounter = metrics.GetOrRegisterCounter("lumbermill.aggregate.points.in", metrics.DefaultRegistry)
+	rollupPointsCounter     = metrics.GetOrRegisterCounter("lumbermill.aggregate.points.out", metrics.DefaultRegistry)
+	latePointsCounter       = metrics.GetOrRegisterCounter("lumbermill.aggregate.points.late", metrics.DefaultRegistry)
+
+	// Series types that can be rolled up with AGGREGATE, and how
+	rollupFactories = map[seriesType]func() rollup{
+		routerRequest: func() rollup { return new(routerRollupState) },
+		routerEvent:   func() rollup { return &routerEventRollupState{codes: make(map[string]int)} },
+	}
+)
+
+// Accumulates the points of one token over one interval
+type rollup interface {
+	add(p point)
+	points(token string, ts int64) []point
+}
+
+type rollupKey struct {
+	token  string
+	bucket int64 // Start of the interval, in microseconds
+}
+
+// One kind of rollup: which series it reads, over what interval, and whether
+// the points it reads are still written as is.
+type rollupStage struct {
+	sources   []seriesType
+	interval  int64 // Microseconds
+	consumes  bool
+	newRollup func() rollup
+	pending   map[rollupKey]rollup
+
+	// Intervals starting before this have been written. Points for them are
+	// dropped, since InfluxDB would keep a second rollup with the same time
+	// rather than replace the first.
+	closed int64
+}
+
+func newRollupStage(interval time.Duration, consumes bool, newRollup func() rollup, sources ...seriesType) *rollupStage {
+	return &rollupStage{
+		sources:   sources,
+		interval:  int64(interval / time.Microsecond),
+		consumes:  consumes,
+		newRollup: newRollup,
+		pending:   make(map[rollupKey]rollup),
+	}
+}
+
+// The start of the interval after the one containing ts.
+func (rs *rollupStage) after(ts int64) int64 {
+	return ts - ts%rs.interval + rs.interval
+}
+
+func (rs *rollupStage) reads(st seriesType) bool {
+	for _, source := range rs.sources {
+		if source == st {
+			return true
+		}
+	}
+	return false
+}
+
+// Rolls points up per token, per interval, for the configured series types.
+// Posters hand it points as they're read, and periodically collect the rolled
+// up points of intervals that have finished.
+type aggregator struct {
+	sync.Mutex
+	stages []*rollupStage
+}
+
+func newAggregator(stages ...*rollupStage) *aggregator {
+	if len(stages) == 0 {
+		return nil
+	}
+	return &aggregator{stages: stages}
+}
+
+// Configures an aggregator from the environment. Returns nil if nothing is
+// aggregated.
+//
+// AGGREGATE maps series names to intervals, e.g. "router:10s|events.router:1m".
+// Points of those series are replaced by their rollups.
+//
+// SKETCH_INTERVAL writes router service and connect time sketches per token
+// per interval, alongside the router points.
+//
+// SLO_INTERVAL writes Apdex, availability and burn rates per token per
+// interval, alongside the router points.
+func newAggregatorFromEnv() *aggregator {
+	var stages []*rollupStage
+
+	for name, v := range parseKeyValueList(os.Getenv("AGGREGATE")) {
+		st, ok := seriesTypeByName(name)
+		newRollup, aggregatable := rollupFactories[st]
+		if !ok || !aggregatable {
+			logger.Warn("aggregate", "err", "series can not be aggregated", "series", name)
+			continue
+		}
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			logger.Warn("aggregate", "err", "invalid interval", "series", name, "interval", v)
+			continue
+		}
+		stages = append(stages, newRollupStage(interval, true, newRollup, st))
+	}
+
+	if interval := envDuration("SKETCH_INTERVAL", 0); interval > 0 {
+		stages = append(stages, newRollupStage(interval, false, newRouterSketchState, routerRequest))
+	}
+
+	if interval := envDuration("SLO_INTERVAL", 0); interval > 0 {
+		stages = append(stages, newRollupStage(interval, false, newSLOTrackerFromEnv().newRollup, routerRequest, routerEvent))
+	}
+
+	return newAggregator(stages...)
+}
+
+// Adds the point to any rollups reading its series. Returns true if the point
+// was consumed and shouldn't be written as is. Skewed points are never rolled
+// up, and points for intervals that have already been written are written as
+// is, rather than lost.
+func (a *aggregator) Add(p point) bool {
+	if a == nil || p.Skewed {
+		return false
+	}
+
+	ts, ok := p.Points[0].(int64)
+	if !ok {
+		return false
+	}
+
+	consumed, late := false, false
+
+	a.Lock()
+	defer a.Unlock()
+
+	for _, stage := range a.stages {
+		if !stage.reads(p.Type) {
+			continue
+		}
+
+		key := rollupKey{token: p.Token, bucket: ts - ts%stage.interval}
+		if key.bucket < stage.closed {
+			latePointsCounter.Inc(1)
+			late = late || stage.consumes
+			continue
+		}
+		r, found := stage.pending[key]
+		if !found {
+			r = stage.newRollup()
+			stage.pending[key] = r
+		}
+		r.add(p)
+		consumed = consumed || stage.consumes
+	}
+
+	if late {
+		return false
+	}
+	if consumed {
+		aggregatedPointsCounter.Inc(1)
+	}
+	return consumed
+}
+
+// Returns the rolled up points for intervals that ended at least one
+// interval before now, giving late points a chance to arrive.
+func (a *aggregator) Due(now time.Time) []point {
+	if a == nil {
+		return nil
+	}
+
+	cutoff := now.UnixNano() / int64(time.Microsecond)
+	return a.collect(func(stage *rollupStage) int64 {
+		return stage.after(cutoff - 2*stage.interval)
+	})
+}
+
+// Returns the rolled up points for intervals that have ended, without waiting
+// for late points. Used to flush a destination on demand.
+func (a *aggregator) Finished(now time.Time) []point {
+	if a == nil {
+		return nil
+	}
+
+	cutoff := now.UnixNano() / int64(time.Microsecond)
+	return a.collect(func(stage *rollupStage) int64 {
+		return stage.after(cutoff - stage.interval)
+	})
+}
+
+// Returns the rolled up points for all intervals, finished or not. Used once
+// the destination is closed, when no more points will arrive.
+func (a *aggregator) Flush() []point {
+	if a == nil {
+		return nil
+	}
+
+	return a.collect(func(*rollupStage) int64 { return math.MaxInt64 })
+}
+
+// Collects the rollups of intervals starting before each stage's end, and
+// closes those intervals.
+func (a *aggregator) collect(end func(*rollupStage) int64) []point {
+	var points []point
+
+	a.Lock()
+	defer a.Unlock()
+
+	for _, stage := range a.stages {
+		closed := end(stage)
+		for key, r := range stage.pending {
+			if key.bucket < closed {
+				points = append(points, r.points(key.token, key.bucket)...)
+				delete(stage.pending, key)
+			}
+		}
+		if closed > stage.closed {
+			stage.closed = closed
+		}
+	}
+
+	rollupPointsCounter.Inc(int64(len(points)))
+	return points
+}
+
+// Counts, status classes and service time distribution for router requests.
+// Sampled requests are weighted by the inverse of their sample rate.
+type routerRollupState struct {
+	count    float64
+	statuses [5]float64
+	service  []weightedValue
+}
+
+type weightedValue struct {
+	value  int
+	weight float64
+}
+
+type byValue []weightedValue
+
+func (v byValue) Len() int           { return len(v) }
+func (v byValue) Less(i, j int) bool { return v[i].value < v[j].value }
+func (v byValue) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+func (r *routerRollupState) add(p point) {
+	status, _ := p.Points[1].(int)
+	service, _ := p.Points[2].(int)
+	weight := sampleWeight(p)
+
+	r.count += weight
+	if class := status / 100; class >= 1 && class <= 5 {
+		r.statuses[class-1] += weight
+	}
+	r.service = append(r.service, weightedValue{service, weight})
+}
+
+func (r *routerRollupState) points(token string, ts int64) []point {
+	sort.Sort(byValue(r.service))
+
+	sum := 0.0
+	for _, s := range r.service {
+		sum += float64(s.value) * s.weight
+	}
+
+	return []point{{
+		Token: token,
+		Type:  routerRollup,
+		Points: []interface{}{
+			ts,
+			roundCount(r.count),
+			roundCount(r.statuses[0]), roundCount(r.statuses[1]), roundCount(r.statuses[2]), roundCount(r.statuses[3]), roundCount(r.statuses[4]),
+			r.service[0].value,
+			r.service[len(r.service)-1].value,
+			sum / r.count,
+			percentile(r.service, r.count, 0.50),
+			percentile(r.service, r.count, 0.95),
+			percentile(r.service, r.count, 0.99),
+		},
+	}}
+}
+
+// Counts of each router error code
+type routerEventRollupState struct {
+	codes map[string]int
+}
+
+func (r *routerEventRollupState) add(p point) {
+	code, _ := p.Points[1].(string)
+	r.codes[code]++
+}
+
+func (r *routerEventRollupState) points(token string, ts int64) []point {
+	points := make([]point, 0, len(r.codes))
+	for code, count := range r.codes {
+		points = append(points, point{Token: token, Type: routerEventRollup, Points: []interface{}{ts, code, count}})
+	}
+	return points
+}
+
+// Nearest rank percentile of sorted values, whose weights sum to total
+func percentile(sorted []weightedValue, total float64, p float64) int {
+	rank := math.Max(math.Ceil(p*total), 1)
+	seen := 0.0
+	for _, v := range sorted {
+		seen += v.weight
+		if seen >= rank {
+			return v.value
+		}
+	}
+	return sorted[len(sorted)-1].value
+}
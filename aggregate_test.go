@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAggregatorRollsUpRouterRequests(t *testing.T) {
+	agg := newAggregator(newRollupStage(10*time.Second, true, rollupFactories[routerRequest], routerRequest))
+
+	// 2014-07-02T00:00:00Z, in microseconds, aligned to 10 seconds
+	bucket := int64(1404259200000000)
+	statuses := []int{200, 200, 302, 404, 503}
+	for i, status := range statuses {
+		p := point{Token: "foo", Type: routerRequest, Points: []interface{}{bucket + int64(i), status, (i + 1) * 10, 1}}
+		if !agg.Add(p) {
+			t.Fatal("router requests should be consumed")
+		}
+	}
+
+	// Not finished yet.
+	if points := agg.Due(time.Unix(0, (bucket+int64(15*time.Second/time.Microsecond))*1000)); len(points) != 0 {
+		t.Fatalf("Expected no points before the interval finished, got %d", len(points))
+	}
+
+	points := agg.Due(time.Unix(0, (bucket+int64(20*time.Second/time.Microsecond))*1000))
+	if len(points) != 1 {
+		t.Fatalf("Expected one rolled up point, got %d", len(points))
+	}
+
+	p := points[0]
+	if p.Type != routerRollup || p.Token != "foo" {
+		t.Errorf("Wrong point: %+v", p)
+	}
+
+	expected := []interface{}{bucket, 5, 0, 2, 1, 1, 1, 10, 50, 30.0, 30, 50, 50}
+	for i, v := range expected {
+		if p.Points[i] != v {
+			t.Errorf("column %s: expected %v, got %v", seriesColumns[routerRollup][i], v, p.Points[i])
+		}
+	}
+
+	if points := agg.Flush(); len(points) != 0 {
+		t.Errorf("Expected nothing left to flush, got %d", len(points))
+	}
+}
+
+func TestAggregatorRollsUpRouterEvents(t *testing.T) {
+	agg := newAggregator(newRollupStage(time.Minute, true, rollupFactories[routerEvent], routerEvent))
+
+	for _, code := range []string{"H12", "H12", "H13"} {
+		agg.Add(point{Token: "foo", Type: routerEvent, Points: []interface{}{int64(1404259200000000), code}})
+	}
+
+	counts := make(map[interface{}]interface{})
+	for _, p := range agg.Flush() {
+		counts[p.Points[1]] = p.Points[2]
+	}
+
+	if counts["H12"] != 2 || counts["H13"] != 1 || len(counts) != 2 {
+		t.Errorf("Wrong counts: %v", counts)
+	}
+}
+
+func TestAggregatorSkipsUnconfiguredSeries(t *testing.T) {
+	agg := newAggregator(newRollupStage(time.Minute, true, rollupFactories[routerRequest], routerRequest))
+
+	if agg.Add(point{Token: "foo", Type: dynoMem, Points: []interface{}{int64(1404259200000000)}}) {
+		t.Error("dyno.mem points should not be aggregated")
+	}
+	if agg.Add(point{Token: "foo", Type: routerRequest, Points: []interface{}{int64(1404259200000000), 200, 1, 1}, Skewed: true}) {
+		t.Error("skewed points should not be aggregated")
+	}
+	if points := agg.Flush(); len(points) != 0 {
+		t.Errorf("Expected nothing to flush, got %d", len(points))
+	}
+
+	var disabled *aggregator
+	if disabled.Add(point{Token: "foo", Type: routerRequest, Points: []interface{}{int64(1404259200000000), 200, 1, 1}}) {
+		t.Error("a nil aggregator should not aggregate")
+	}
+}
+
+func TestAggregatorObservingStageDoesNotConsume(t *testing.T) {
+	agg := newAggregator(newRollupStage(time.Minute, false, newRouterSketchState, routerRequest))
+
+	if agg.Add(point{Token: "foo", Type: routerRequest, Points: []interface{}{int64(1404259200000000), 200, 10, 1}}) {
+		t.Error("sketched router points should still be written")
+	}
+
+	points := agg.Flush()
+	if len(points) != 1 || points[0].Type != routerSketch {
+		t.Errorf("Expected one sketch point, got %+v", points)
+	}
+}
+
+func TestAggregatorWritesLatePoints(t *testing.T) {
+	agg := newAggregator(newRollupStage(10*time.Second, true, rollupFactories[routerRequest], routerRequest))
+	bucket := int64(1404259200000000)
+	at := func(offset time.Duration) time.Time {
+		return time.Unix(0, (bucket+int64(offset/time.Microsecond))*1000)
+	}
+	request := func(ts int64) point {
+		return point{Token: "foo", Type: routerRequest, Points: []interface{}{ts, 200, 10, 1}}
+	}
+
+	agg.Add(request(bucket))
+	agg.Add(request(bucket + int64(10*time.Second/time.Microsecond)))
+
+	// An on demand flush writes the finished interval, but not the current one.
+	points := agg.Finished(at(15 * time.Second))
+	if len(points) != 1 || points[0].Points[0] != bucket {
+		t.Fatalf("Expected only the finished interval, got %+v", points)
+	}
+
+	// The written interval isn't written again; late points are written as is.
+	before := latePointsCounter.Count()
+	if agg.Add(request(bucket + 1)) {
+		t.Error("Expected a late point not to be consumed")
+	}
+	if latePointsCounter.Count()-before != 1 {
+		t.Error("Expected the late point to be counted")
+	}
+	points = agg.Due(at(time.Minute))
+	if len(points) != 1 || points[0].Points[0] != bucket+int64(10*time.Second/time.Microsecond) {
+		t.Errorf("Expected only the second interval, got %+v", points)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+const (
+	alertPointsCapacity        = 100000
+	alertNotificationsCapacity = 1000
+	alertSweepInterval         = 10 * time.Second
+	alertIdleTimeout           = 15 * time.Minute // Threshold states without points are forgotten after this
+	alertRateBucket            = time.Second      // Rate rules count arrivals per bucket of this width
+	defaultWebhookRetries      = 3
+	defaultWebhookTimeout      = 10 * time.Second
+)
+
+var (
+	alertDroppedCounter  = metrics.GetOrRegisterCounter("lumbermill.alerts.dropped", metrics.DefaultRegistry)
+	alertFiredCounter    = metrics.GetOrRegisterCounter("lumbermill.alerts.fired", metrics.DefaultRegistry)
+	alertResolvedCounter = metrics.GetOrRegisterCounter("lumbermill.alerts.resolved", metrics.DefaultRegistry)
+	webhookFailedCounter = metrics.GetOrRegisterCounter("lumbermill.alerts.webhook.failed", metrics.DefaultRegistry)
+)
+
+// A rule evaluated against the points of a series.
+//
+// Rate rules (no Column) fire when more than Above matching points arrive
+// within Per, to the second, e.g. more than 5 H12s a minute.
+//
+// Threshold rules fire when Column is above Above (or below Below) for Samples
+// consecutive matching points, e.g. memory_total above 500 for 3 samples.
+//
+// Rules are evaluated per token, and per value of GroupBy if set.
+type alertRule struct {
+	Name    string            `json:"name"`
+	Token   string            `json:"token"` // Empty matches every token
+	Series  string            `json:"series"`
+	Where   map[string]string `json:"where"`
+	GroupBy string            `json:"group_by"`
+	Per     string            `json:"per"`
+	Column  string            `json:"column"`
+	Above   *float64          `json:"above"`
+	Below   *float64          `json:"below"`
+	Samples int               `json:"samples"`
+	Webhook string            `json:"webhook"` // Overrides alertConfig.Webhook
+
+	seriesType seriesType
+	per        time.Duration
+	columns    map[string]int
+}
+
+// The contents of ALERT_RULES_FILE
+type alertConfig struct {
+	Webhook string       `json:"webhook"`
+	Retries int          `json:"retries"`
+	Rules   []*alertRule `json:"rules"`
+}
+
+func (r *alertRule) init() error {
+	var ok bool
+	if r.seriesType, ok = seriesTypeByName(r.Series); !ok {
+		return fmt.Errorf("rule %q: unknown series %q", r.Name, r.Series)
+	}
+	if r.seriesType.Derived() {
+		return fmt.Errorf("rule %q: %s is computed after alerts are evaluated", r.Name, r.Series)
+	}
+
+	r.columns = make(map[string]int)
+	for i, c := range r.seriesType.Columns() {
+		r.columns[c] = i
+	}
+	for c := range r.Where {
+		if _, ok := r.columns[c]; !ok {
+			return fmt.Errorf("rule %q: unknown column %q", r.Name, c)
+		}
+	}
+	if _, ok := r.columns[r.GroupBy]; r.GroupBy != "" && !ok {
+		return fmt.Errorf("rule %q: unknown group_by column %q", r.Name, r.GroupBy)
+	}
+
+	if r.Column == "" {
+		per, err := time.ParseDuration(r.Per)
+		if err != nil || per < alertRateBucket {
+			return fmt.Errorf("rule %q: rate rules need a per of at least %s", r.Name, alertRateBucket)
+		}
+		if r.Above == nil {
+			return fmt.Errorf("rule %q: rate rules need above", r.Name)
+		}
+		r.per = per
+		return nil
+	}
+
+	if _, ok := r.columns[r.Column]; !ok {
+		return fmt.Errorf("rule %q: unknown column %q", r.Name, r.Column)
+	}
+	if r.Above == nil && r.Below == nil {
+		return fmt.Errorf("rule %q: threshold rules need above or below", r.Name)
+	}
+	if r.Samples <= 0 {
+		r.Samples = 1
+	}
+	return nil
+}
+
+func (r *alertRule) matches(p point) bool {
+	if p.Type != r.seriesType || (r.Token != "" && r.Token != p.Token) {
+		return false
+	}
+	for c, v := range r.Where {
+		if fmt.Sprint(p.Points[r.columns[c]]) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *alertRule) breaches(v float64) bool {
+	return (r.Above != nil && v > *r.Above) || (r.Below != nil && v < *r.Below)
+}
+
+func (r *alertRule) threshold() float64 {
+	if r.Above != nil {
+		return *r.Above
+	}
+	return *r.Below
+}
+
+type alertKey struct {
+	rule  *alertRule
+	token string
+	group string
+}
+
+type alertState struct {
+	firing      bool
+	arrivals    rateWindow // Rate rules
+	consecutive int        // Threshold rules
+	value       float64
+	lastSeen    time.Time
+}
+
+// The JSON payload POSTed to webhooks
+type alertNotification struct {
+	Status    string    `json:"status"` // firing or resolved
+	Rule      string    `json:"rule"`
+	Token     string    `json:"token"`
+	Group     string    `json:"group,omitempty"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	DedupKey  string    `json:"dedup_key"`
+	At        time.Time `json:"at"`
+
+	webhook string
+}
+
+// Evaluates alert rules against points as they're posted. Points are handed
+// off through a buffered channel, and dropped rather than blocking when it's
+// full.
+type alerter struct {
+	config        *alertConfig
+	points        chan point
+	notifications chan alertNotification
+	states        map[alertKey]*alertState
+	client        *http.Client
+}
+
+func newAlerter(config *alertConfig) (*alerter, error) {
+	for _, r := range config.Rules {
+		if err := r.init(); err != nil {
+			return nil, err
+		}
+		if r.Webhook == "" && config.Webhook == "" {
+			return nil, fmt.Errorf("rule %q: no webhook", r.Name)
+		}
+	}
+	if config.Retries <= 0 {
+		config.Retries = defaultWebhookRetries
+	}
+
+	return &alerter{
+		config:        config,
+		points:        make(chan point, alertPointsCapacity),
+		notifications: make(chan alertNotification, alertNotificationsCapacity),
+		states:        make(map[alertKey]*alertState),
+		client:        &http.Client{Timeout: defaultWebhookTimeout},
+	}, nil
+}
+
+// Loads alert rules from the JSON file named by ALERT_RULES_FILE. Returns nil
+// if it isn't set.
+func newAlerterFromEnv() (*alerter, error) {
+	path := os.Getenv("ALERT_RULES_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(alertConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return newAlerter(config)
+}
+
+func (a *alerter) Run() {
+	go a.notify()
+
+	sweep := time.NewTicker(alertSweepInterval)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case p := <-a.points:
+			a.evaluate(p, time.Now())
+		case now := <-sweep.C:
+			a.sweep(now)
+		}
+	}
+}
+
+// Hands the point to the alerter without blocking
+func (a *alerter) Observe(p point) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.points <- p:
+	default:
+		alertDroppedCounter.Inc(1)
+	}
+}
+
+func (a *alerter) evaluate(p point, now time.Time) {
+	for _, r := range a.config.Rules {
+		if !r.matches(p) {
+			continue
+		}
+
+		key := alertKey{rule: r, token: p.Token}
+		if r.GroupBy != "" {
+			key.group = fmt.Sprint(p.Points[r.columns[r.GroupBy]])
+		}
+		state, ok := a.states[key]
+		if !ok {
+			state = new(alertState)
+			a.states[key] = state
+		}
+		state.lastSeen = now
+
+		if r.Column == "" {
+			state.arrivals.trim(now.Add(-r.per))
+			state.arrivals.add(now, sampleWeight(p))
+			state.value = state.arrivals.total
+		} else {
+			v, ok := toFloat(p.Points[r.columns[r.Column]])
+			if !ok {
+				continue
+			}
+			state.value = v
+			if r.breaches(v) {
+				state.consecutive++
+			} else {
+				state.consecutive = 0
+			}
+		}
+
+		a.transition(key, state, now)
+	}
+}
+
+// Re-evaluates rate rules that haven't seen points recently, and forgets
+// threshold states that haven't seen any for alertIdleTimeout, e.g. for dynos
+// that are gone, resolving them if they were firing.
+func (a *alerter) sweep(now time.Time) {
+	for key, state := range a.states {
+		if key.rule.Column != "" {
+			if now.Sub(state.lastSeen) >= alertIdleTimeout {
+				state.consecutive = 0
+				a.transition(key, state, now)
+				delete(a.states, key)
+			}
+			continue
+		}
+
+		state.arrivals.trim(now.Add(-key.rule.per))
+		state.value = state.arrivals.total
+		a.transition(key, state, now)
+
+		if !state.firing && len(state.arrivals.buckets) == 0 {
+			delete(a.states, key)
+		}
+	}
+}
+
+// Notifies when a rule starts or stops breaching. Repeated breaches while
+// already firing are deduplicated.
+func (a *alerter) transition(key alertKey, state *alertState, now time.Time) {
+	var breaching bool
+	if key.rule.Column == "" {
+		breaching = key.rule.breaches(state.value)
+	} else {
+		breaching = state.consecutive >= key.rule.Samples
+	}
+
+	if breaching == state.firing {
+		return
+	}
+	state.firing = breaching
+
+	status := "resolved"
+	if breaching {
+		status = "firing"
+		alertFiredCounter.Inc(1)
+	} else {
+		alertResolvedCounter.Inc(1)
+	}
+
+	webhook := key.rule.Webhook
+	if webhook == "" {
+		webhook = a.config.Webhook
+	}
+
+	n := alertNotification{
+		Status:    status,
+		Rule:      key.rule.Name,
+		Token:     key.token,
+		Group:     key.group,
+		Value:     state.value,
+		Threshold: key.rule.threshold(),
+		DedupKey:  key.rule.Name + "/" + key.token + "/" + key.group,
+		At:        now.UTC(),
+		webhook:   webhook,
+	}
+
+	select {
+	case a.notifications <- n:
+	default:
+		webhookFailedCounter.Inc(1)
+		logger.Error("alert", "err", "notification queue full", "rule", n.Rule, "token", n.Token, "status", n.Status)
+	}
+}
+
+func (a *alerter) notify() {
+	for n := range a.notifications {
+		a.send(n)
+	}
+}
+
+// POSTs the notification, retrying with exponential backoff.
+func (a *alerter) send(n alertNotification) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		webhookFailedCounter.Inc(1)
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 1; attempt <= a.config.Retries; attempt++ {
+		resp, err := a.client.Post(n.webhook, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("webhook returned %d", resp.StatusCode)
+		}
+
+		logger.Warn("alert", "err", err, "rule", n.Rule, "token", n.Token, "status", n.Status, "attempt", attempt)
+		if attempt < a.config.Retries {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	webhookFailedCounter.Inc(1)
+}
+
+// The matching points of one alertRateBucket, and how many they stand for
+// if they were sampled
+type arrival struct {
+	at     time.Time
+	weight float64
+}
+
+// The arrivals within a rate rule's Per, bucketed so that each point costs
+// the same however many arrive.
+type rateWindow struct {
+	buckets []arrival // Oldest first
+	total   float64
+}
+
+func (w *rateWindow) add(at time.Time, weight float64) {
+	at = at.Truncate(alertRateBucket)
+	if n := len(w.buckets); n > 0 && !at.After(w.buckets[n-1].at) {
+		w.buckets[n-1].weight += weight
+	} else {
+		w.buckets = append(w.buckets, arrival{at, weight})
+	}
+	w.total += weight
+}
+
+// Forgets the buckets that ended at or before since
+func (w *rateWindow) trim(since time.Time) {
+	i := 0
+	for i < len(w.buckets) && !w.buckets[i].at.Add(alertRateBucket).After(since) {
+		w.total -= w.buckets[i].weight
+		i++
+	}
+	w.buckets = w.buckets[i:]
+	if len(w.buckets) == 0 {
+		w.total = 0
+	}
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func newTestAlerter(t *testing.T, rules ...*alertRule) *alerter {
+	a, err := newAlerter(&alertConfig{Webhook: "http://localhost/hook", Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func expectNotification(t *testing.T, a *alerter, status string) alertNotification {
+	select {
+	case n := <-a.notifications:
+		if n.Status != status {
+			t.Errorf("Expected a %s notification, got %+v", status, n)
+		}
+		return n
+	default:
+		t.Fatalf("Expected a %s notification, got none", status)
+	}
+	return alertNotification{}
+}
+
+func expectNoNotification(t *testing.T, a *alerter) {
+	select {
+	case n := <-a.notifications:
+		t.Errorf("Unexpected notification: %+v", n)
+	default:
+	}
+}
+
+func TestAlertRateRule(t *testing.T) {
+	a := newTestAlerter(t, &alertRule{Name: "h12", Series: "events.router", Where: map[string]string{"code": "H12"}, Per: "1m", Above: float(2)})
+	now := time.Now()
+	h12 := point{Token: "foo", Type: routerEvent, Points: []interface{}{int64(0), "H12"}}
+	h13 := point{Token: "foo", Type: routerEvent, Points: []interface{}{int64(0), "H13"}}
+
+	a.evaluate(h12, now)
+	a.evaluate(h13, now)
+	a.evaluate(h12, now)
+	expectNoNotification(t, a)
+
+	a.evaluate(h12, now)
+	n := expectNotification(t, a, "firing")
+	if n.Token != "foo" || n.Value != 3 || n.Threshold != 2 {
+		t.Errorf("Wrong notification: %+v", n)
+	}
+
+	// Already firing, so deduplicated.
+	a.evaluate(h12, now)
+	expectNoNotification(t, a)
+
+	a.sweep(now.Add(2 * time.Minute))
+	expectNotification(t, a, "resolved")
+
+	if len(a.states) != 0 {
+		t.Errorf("Expected resolved rate state to be forgotten, have %d", len(a.states))
+	}
+}
+
+func TestRateWindow(t *testing.T) {
+	var w rateWindow
+	start := time.Unix(1000, 0)
+	for i := 0; i < 1000; i++ {
+		w.add(start.Add(time.Duration(i)*time.Millisecond), 1)
+	}
+	w.add(start.Add(time.Second), 2)
+	if len(w.buckets) != 2 || w.total != 1002 {
+		t.Fatalf("Expected 2 buckets totalling 1002, got %d totalling %v", len(w.buckets), w.total)
+	}
+
+	w.trim(start.Add(time.Second))
+	if len(w.buckets) != 1 || w.total != 2 {
+		t.Errorf("Expected the first bucket to be forgotten, got %d totalling %v", len(w.buckets), w.total)
+	}
+
+	w.trim(start.Add(time.Minute))
+	if len(w.buckets) != 0 || w.total != 0 {
+		t.Errorf("Expected an empty window, got %d totalling %v", len(w.buckets), w.total)
+	}
+}
+
+func TestAlertThresholdRule(t *testing.T) {
+	a := newTestAlerter(t, &alertRule{Name: "mem", Series: "dyno.mem", Column: "memory_total", GroupBy: "source", Above: float(500), Samples: 3})
+	now := time.Now()
+	sample := func(source string, total float64) point {
+		return point{Token: "foo", Type: dynoMem, Points: []interface{}{int64(0), source, 0.0, 0, 0, 0.0, 0.0, total, "web"}}
+	}
+
+	a.evaluate(sample("web.1", 510), now)
+	a.evaluate(sample("web.1", 520), now)
+	a.evaluate(sample("web.2", 530), now)
+	expectNoNotification(t, a)
+
+	a.evaluate(sample("web.1", 530), now)
+	n := expectNotification(t, a, "firing")
+	if n.Group != "web.1" || n.Value != 530 {
+		t.Errorf("Wrong notification: %+v", n)
+	}
+
+	a.evaluate(sample("web.1", 400), now)
+	expectNotification(t, a, "resolved")
+
+	// Sources that stop reporting are forgotten, resolving if they were firing.
+	for i := 0; i < 3; i++ {
+		a.evaluate(sample("web.2", 540), now)
+	}
+	expectNotification(t, a, "firing")
+	a.sweep(now.Add(alertIdleTimeout - time.Second))
+	expectNoNotification(t, a)
+	a.sweep(now.Add(alertIdleTimeout))
+	n = expectNotification(t, a, "resolved")
+	if n.Group != "web.2" || len(a.states) != 0 {
+		t.Errorf("Expected idle states to be forgotten, resolved %+v and have %d", n, len(a.states))
+	}
+}
+
+func TestAlertRuleValidation(t *testing.T) {
+	invalid := map[string]*alertRule{
+		"unknown series": {Name: "x", Series: "nope", Per: "1m", Above: float(1)},
+		"unknown column": {Name: "x", Series: "dyno.mem", Column: "nope", Above: float(1)},
+		"no per":         {Name: "x", Series: "events.router", Above: float(1)},
+		"per under 1s":   {Name: "x", Series: "events.router", Per: "10ms", Above: float(1)},
+		"no threshold":   {Name: "x", Series: "dyno.mem", Column: "memory_total"},
+		"derived series": {Name: "x", Series: "slo", Column: "availability", Below: float(0.99)},
+	}
+
+	for name, rule := range invalid {
+		if _, err := newAlerter(&alertConfig{Webhook: "http://localhost/hook", Rules: []*alertRule{rule}}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAlertWebhookRetries(t *testing.T) {
+	attempts := 0
+	received := make(chan alertNotification, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var n alertNotification
+		json.NewDecoder(r.Body).Decode(&n)
+		received <- n
+	}))
+	defer webhook.Close()
+
+	a := newTestAlerter(t)
+	a.send(alertNotification{Status: "firing", Rule: "h12", Token: "foo", webhook: webhook.URL})
+
+	select {
+	case n := <-received:
+		if n.Rule != "h12" || n.Status != "firing" {
+			t.Errorf("Wrong notification: %+v", n)
+		}
+	default:
+		t.Fatal("Webhook did not receive the notification")
+	}
+}
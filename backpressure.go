@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+const (
+	defaultBackpressureRetryAfter = 5 * time.Second
+)
+
+var (
+	backpressureRejectedCounter = metrics.GetOrRegisterCounter("lumbermill.backpressure.rejected", metrics.DefaultRegistry)
+	backpressureEngagedCounter  = metrics.GetOrRegisterCounter("lumbermill.backpressure.engaged", metrics.DefaultRegistry)
+	backpressureReleasedCounter = metrics.GetOrRegisterCounter("lumbermill.backpressure.released", metrics.DefaultRegistry)
+)
+
+// Rejects drain batches, before reading them, while their destinations' queues
+// are too full, so Logplex buffers and retries them instead of lumbermill
+// dropping points. A destination becomes overloaded when its queue fills past
+// the high water mark, and stays overloaded until it drains below the low
+// water mark, so batches aren't alternately accepted and rejected.
+type backpressure struct {
+	high       float64 // Fractions of queue capacity
+	low        float64
+	status     int
+	retryAfter time.Duration
+}
+
+// Configures backpressure from BACKPRESSURE_HIGH_WATER (e.g. 0.8, unset
+// disables it), BACKPRESSURE_LOW_WATER (default half the high water mark),
+// BACKPRESSURE_STATUS (503 or 429) and BACKPRESSURE_RETRY_AFTER.
+func newBackpressureFromEnv() *backpressure {
+	high := envFloat("BACKPRESSURE_HIGH_WATER", 0)
+	if high <= 0 {
+		return nil
+	}
+
+	b := &backpressure{
+		high:       high,
+		low:        envFloat("BACKPRESSURE_LOW_WATER", high/2),
+		status:     envInt("BACKPRESSURE_STATUS", http.StatusServiceUnavailable),
+		retryAfter: envDuration("BACKPRESSURE_RETRY_AFTER", defaultBackpressureRetryAfter),
+	}
+	if b.status != http.StatusServiceUnavailable && b.status != http.StatusTooManyRequests {
+		logger.Warn("backpressure", "err", "status must be 503 or 429", "status", b.status, "default", http.StatusServiceUnavailable)
+		b.status = http.StatusServiceUnavailable
+	}
+	if b.low > b.high {
+		b.low = b.high
+	}
+	return b
+}
+
+// Whether the destination is overloaded, updating its state from its queue
+// depth.
+func (b *backpressure) overloaded(d *destination) bool {
+	capacity := cap(d.points)
+	if capacity == 0 {
+		return false
+	}
+	fill := float64(d.Load()) / float64(capacity)
+
+	switch {
+	case fill >= b.high:
+		if atomic.CompareAndSwapInt32(&d.overloaded, 0, 1) {
+			backpressureEngagedCounter.Inc(1)
+			logger.Warn("backpressure-engaged", "destination", d.Name, "fill", fill)
+		}
+	case fill <= b.low:
+		if atomic.CompareAndSwapInt32(&d.overloaded, 1, 0) {
+			backpressureReleasedCounter.Inc(1)
+			logger.Info("backpressure-released", "destination", d.Name, "fill", fill)
+		}
+	}
+	return atomic.LoadInt32(&d.overloaded) == 1
+}
+
+// Whether a batch for these replicas should be rejected: when too few of them
+// can take it to meet the write consistency of the replication factor.
+func (b *backpressure) Reject(replicas []*destination, factor int, consistency writeConsistency) bool {
+	if b == nil || len(replicas) == 0 {
+		return false
+	}
+
+	accepting := 0
+	for _, d := range replicas {
+		if !b.overloaded(d) {
+			accepting++
+		}
+	}
+	return accepting < consistency.Required(factor)
+}
+
+// Whether any of the destinations is overloaded.
+func (b *backpressure) Overloaded(destinations []*destination) bool {
+	overloaded := false
+	for _, d := range destinations {
+		if b.overloaded(d) {
+			overloaded = true
+		}
+	}
+	return overloaded
+}
+
+// Rejects the batch, asking the sender to retry later.
+func (b *backpressure) respond(w http.ResponseWriter) {
+	backpressureRejectedCounter.Inc(1)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(b.retryAfter)))
+	w.WriteHeader(b.status)
+}
+
+// Retry-After is in whole seconds, so round up, to at least 1: 0 would ask
+// for an immediate retry.
+func retryAfterSeconds(d time.Duration) int {
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
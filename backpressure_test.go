@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+)
+
+func TestBackpressureHysteresis(t *testing.T) {
+	b := &backpressure{high: 0.8, low: 0.5, status: http.StatusServiceUnavailable, retryAfter: time.Second}
+	d := newDestination("d", 10)
+
+	fillDestination(d, 7)
+	if b.overloaded(d) {
+		t.Fatal("Expected 70% full to be below the high water mark")
+	}
+
+	fillDestination(d, 1)
+	if !b.overloaded(d) {
+		t.Fatal("Expected 80% full to engage backpressure")
+	}
+
+	// Draining to between the marks keeps it engaged.
+	<-d.points
+	<-d.points
+	if !b.overloaded(d) {
+		t.Fatal("Expected backpressure to stay engaged above the low water mark")
+	}
+
+	<-d.points
+	if b.overloaded(d) {
+		t.Fatal("Expected 50% full to release backpressure")
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	testCases := map[time.Duration]int{
+		0:                       1,
+		500 * time.Millisecond:  1,
+		time.Second:             1,
+		1500 * time.Millisecond: 2,
+		5 * time.Second:         5,
+	}
+	for d, expected := range testCases {
+		if got := retryAfterSeconds(d); got != expected {
+			t.Errorf("%s: expected %d, got %d", d, expected, got)
+		}
+	}
+}
+
+func TestDrainBackpressure(t *testing.T) {
+	routes := newRoutes(newTestClientFunc)
+	d := newDestination("d", 10)
+	routes.Ring().Add(d)
+
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, routes)
+	server.backpressure = &backpressure{high: 0.8, low: 0.5, status: http.StatusTooManyRequests, retryAfter: 5 * time.Second}
+	fillDestination(d, 9)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/drain", strings.NewReader(""))
+	req.Header.Set("Logplex-Drain-Token", "t.token")
+	server.http.Handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "5" {
+		t.Errorf("Expected a 429 with Retry-After, got %d %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/health", nil)
+	server.http.Handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /health to report overload, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+const (
+	defaultBreakerFailureRate = 0.5
+	defaultBreakerMinRequests = 10
+	defaultBreakerWindow      = 30 * time.Second
+	defaultBreakerCooldown    = 30 * time.Second
+
+	// Run checks whether the cooldown has passed every quarter cooldown.
+	minBreakerCooldown = time.Second
+)
+
+var failoverCounter = metrics.GetOrRegisterCounter("lumbermill.ring.failover", metrics.DefaultRegistry)
+
+// A circuit breaker for a destination. Posters report the outcome of each
+// write, and the breaker opens when too many fail within a window. While
+// open, the ring routes new points to the next healthy destination. After a
+// cooldown the destination is health checked, and the breaker closes once the
+// check passes.
+type circuitBreaker struct {
+	sync.Mutex
+	name        string
+	failureRate float64
+	minRequests int
+	window      time.Duration
+	cooldown    time.Duration
+	check       func() error
+	done        chan struct{}
+
+	open        bool
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	openedCounter metrics.Counter
+	closedCounter metrics.Counter
+	stateGauge    metrics.Gauge
+}
+
+func newCircuitBreaker(name string, failureRate float64, minRequests int, window, cooldown time.Duration, check func() error) *circuitBreaker {
+	return &circuitBreaker{
+		name:          name,
+		failureRate:   failureRate,
+		minRequests:   minRequests,
+		window:        window,
+		cooldown:      cooldown,
+		check:         check,
+		done:          make(chan struct{}),
+		windowStart:   time.Now(),
+		openedCounter: metrics.GetOrRegisterCounter("lumbermill.breaker.opened."+name, metrics.DefaultRegistry),
+		closedCounter: metrics.GetOrRegisterCounter("lumbermill.breaker.closed."+name, metrics.DefaultRegistry),
+		stateGauge:    metrics.GetOrRegisterGauge("lumbermill.breaker.open."+name, metrics.DefaultRegistry),
+	}
+}
+
+// Configures a breaker from BREAKER_FAILURE_RATE, BREAKER_MIN_REQUESTS,
+// BREAKER_WINDOW and BREAKER_COOLDOWN. A failure rate of 0 disables it.
+func newCircuitBreakerFromEnv(name string, check func() error) *circuitBreaker {
+	failureRate := envFloat("BREAKER_FAILURE_RATE", defaultBreakerFailureRate)
+	if failureRate <= 0 {
+		return nil
+	}
+
+	minRequests := envInt("BREAKER_MIN_REQUESTS", defaultBreakerMinRequests)
+	if minRequests < 1 {
+		logger.Warn("breaker", "err", "BREAKER_MIN_REQUESTS must be at least 1", "min_requests", minRequests)
+		minRequests = defaultBreakerMinRequests
+	}
+	window := envDuration("BREAKER_WINDOW", defaultBreakerWindow)
+	if window <= 0 {
+		logger.Warn("breaker", "err", "BREAKER_WINDOW must be positive", "window", window)
+		window = defaultBreakerWindow
+	}
+	cooldown := envDuration("BREAKER_COOLDOWN", defaultBreakerCooldown)
+	if cooldown < minBreakerCooldown {
+		logger.Warn("breaker", "err", "BREAKER_COOLDOWN must be at least "+minBreakerCooldown.String(), "cooldown", cooldown)
+		cooldown = defaultBreakerCooldown
+	}
+
+	return newCircuitBreaker(name, failureRate, minRequests, window, cooldown, check)
+}
+
+// Whether new points should be sent to the destination
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	return !b.open
+}
+
+// "open", "closed", or "disabled" for a nil breaker
+func (b *circuitBreaker) State() string {
+	if b == nil {
+		return "disabled"
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.open {
+		return "open"
+	}
+	return "closed"
+}
+
+func (b *circuitBreaker) Success() {
+	b.record(false)
+}
+
+func (b *circuitBreaker) Failure() {
+	b.record(true)
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.windowStart) > b.window {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+
+	b.requests++
+	if failed {
+		b.failures++
+	}
+
+	if !b.open && b.requests >= b.minRequests && float64(b.failures)/float64(b.requests) >= b.failureRate {
+		b.open = true
+		b.openedAt = now
+		b.openedCounter.Inc(1)
+		b.stateGauge.Update(1)
+		logger.Warn("breaker-open", "destination", b.name, "failures", b.failures, "requests", b.requests, "msg", "failing over to the next destination on the ring")
+	}
+}
+
+// Health checks the destination once the cooldown has passed, closing the
+// breaker if the check passes. Returns once the breaker is closed.
+func (b *circuitBreaker) Run() {
+	ticker := time.NewTicker(b.cooldown / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			b.Lock()
+			due := b.open && now.Sub(b.openedAt) >= b.cooldown
+			b.Unlock()
+
+			if due {
+				b.probe(now)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Stops health checking, when the destination is removed.
+func (b *circuitBreaker) Close() error {
+	if b == nil {
+		return nil
+	}
+	close(b.done)
+	return nil
+}
+
+func (b *circuitBreaker) probe(now time.Time) {
+	err := b.check()
+
+	b.Lock()
+	defer b.Unlock()
+
+	if err != nil {
+		b.openedAt = now
+		logger.Warn("breaker-check", "destination", b.name, "err", err)
+		return
+	}
+
+	b.open = false
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+	b.closedCounter.Inc(1)
+	b.stateGauge.Update(0)
+	logger.Info("breaker-close", "destination", b.name, "msg", "failing back")
+}
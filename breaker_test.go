@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensOnFailureRate(t *testing.T) {
+	b := newCircuitBreaker("test", 0.5, 4, time.Minute, time.Minute, nil)
+
+	b.Success()
+	b.Failure()
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("Breaker opened before the minimum number of requests")
+	}
+
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("Expected the breaker to open at a 75% failure rate")
+	}
+}
+
+func TestCircuitBreakerClosesWhenCheckPasses(t *testing.T) {
+	checkErr := errors.New("still down")
+	b := newCircuitBreaker("test", 0.5, 1, time.Minute, time.Minute, func() error { return checkErr })
+
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("Expected the breaker to open")
+	}
+
+	b.probe(time.Now())
+	if b.Allow() {
+		t.Fatal("Expected the breaker to stay open while the check fails")
+	}
+
+	checkErr = nil
+	b.probe(time.Now())
+	if !b.Allow() {
+		t.Fatal("Expected the breaker to close once the check passes")
+	}
+}
+
+func TestHashRingFailsOverOpenBreakers(t *testing.T) {
+	hash := newHashRing(3, func(key []byte) uint32 {
+		i, err := strconv.Atoi(string(key))
+		if err != nil {
+			panic(err)
+		}
+		return uint32(i)
+	})
+
+	two := newDestination("2", 1)
+	four := newDestination("4", 1)
+	six := newDestination("6", 1)
+	hash.Add(six, four, two)
+
+	// 3 hashes to the "4" replica, the next on the ring is "6".
+	if hash.Get("3") != four {
+		t.Fatalf("Expected 3 to map to 4")
+	}
+
+	four.breaker = newCircuitBreaker("4", 0.5, 1, time.Minute, time.Minute, func() error { return nil })
+	four.breaker.Failure()
+
+	before := failoverCounter.Count()
+	if hash.Get("3") != six {
+		t.Errorf("Expected 3 to fail over to 6 while 4's breaker is open")
+	}
+	if failoverCounter.Count()-before != 1 {
+		t.Errorf("Expected the failover to be counted")
+	}
+
+	four.breaker.probe(time.Now())
+	if hash.Get("3") != four {
+		t.Errorf("Expected 3 to fail back to 4 once its breaker closed")
+	}
+}
+
+func TestCircuitBreakerFromEnvDefaults(t *testing.T) {
+	os.Setenv("BREAKER_MIN_REQUESTS", "0")
+	os.Setenv("BREAKER_WINDOW", "-1s")
+	os.Setenv("BREAKER_COOLDOWN", "3ns")
+	defer os.Unsetenv("BREAKER_MIN_REQUESTS")
+	defer os.Unsetenv("BREAKER_WINDOW")
+	defer os.Unsetenv("BREAKER_COOLDOWN")
+
+	b := newCircuitBreakerFromEnv("env", nil)
+	if b.minRequests != defaultBreakerMinRequests || b.window != defaultBreakerWindow || b.cooldown != defaultBreakerCooldown {
+		t.Errorf("Expected invalid settings to fall back to the defaults, got %d %s %s", b.minRequests, b.window, b.cooldown)
+	}
+}
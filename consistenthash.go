@@ -17,6 +17,14 @@ Changelog:
 
  - 2014-07-02 (apg): Modified to support storing a Destination instead
    of string key
+ - Get skips destinations whose circuit breaker is open
+ - GetN returns the n closest distinct destinations for replication
+ - Rings are versioned, and list their destinations
+ - Optionally bounds the load of each destination, overflowing keys to the
+   next destination on the ring
+ - Implements Router, sharing failover and load bounds with the other
+   algorithms
+ - Owners returns the closest items by topology alone
 
 */
 
@@ -31,6 +39,7 @@ import (
 type hashFn func(data []byte) uint32
 
 type hashRing struct {
+	routerState
 	hash     hashFn
 	replicas int
 	keys     []int // Sorted
@@ -69,15 +78,39 @@ func (m *hashRing) Add(destinations ...*destination) {
 			m.hashMap[hash] = destination
 		}
 		sort.Ints(m.keys)
+		m.add(destination)
 	}
 }
 
-// Gets the closest item in the hash to the provided key.
+// Gets the closest item in the hash to the provided key. If its circuit
+// breaker is open, the next available item on the ring is returned instead.
 func (m *hashRing) Get(key string) *destination {
-	if m.IsEmpty() {
+	return first(m.GetN(key, 1))
+}
+
+// Gets the n closest distinct items in the hash to the provided key, walking
+// the ring. Items whose circuit breaker is open, or whose load is above the
+// bound, are skipped in favour of the next ones, unless there aren't enough
+// other items.
+func (m *hashRing) GetN(key string, n int) []*destination {
+	if m.IsEmpty() || n <= 0 {
+		return nil
+	}
+	return m.pick(n, func(visit func(*destination) bool) { m.walk(key, visit) })
+}
+
+// Gets the n closest distinct items in the hash to the provided key, whether
+// or not they're available.
+func (m *hashRing) Owners(key string, n int) []*destination {
+	if m.IsEmpty() || n <= 0 {
 		return nil
 	}
+	return m.owners(n, func(visit func(*destination) bool) { m.walk(key, visit) })
+}
 
+// Visits the distinct items in the hash in ring order from the key, until
+// visit returns false.
+func (m *hashRing) walk(key string, visit func(*destination) bool) {
 	hash := int(m.hash([]byte(key)))
 
 	// Binary search for appropriate replica.
@@ -88,5 +121,15 @@ func (m *hashRing) Get(key string) *destination {
 		idx = 0
 	}
 
-	return m.hashMap[m.keys[idx]]
+	var seen []*destination
+	for i := 0; i < len(m.keys) && len(seen) < len(m.destinations); i++ {
+		d := m.hashMap[m.keys[(idx+i)%len(m.keys)]]
+		if containsDestination(seen, d) {
+			continue
+		}
+		seen = append(seen, d)
+		if !visit(d) {
+			return
+		}
+	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sync"
 	"time"
 
 	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
@@ -11,10 +12,28 @@ type destination struct {
 	Name       string
 	points     chan point
 	depthGauge metrics.Gauge
+	aggregator *aggregator // nil unless points are rolled up before delivery
+	spool      *spool      // nil unless failed and overflowing points are spooled to disk
+	breaker    *circuitBreaker
+
+	// Guards points, which is closed when the destination is removed from the
+	// ring or on shutdown, against posts from requests still using an old ring.
+	closeLock sync.RWMutex
+	closed    bool
+
+	overloaded int32 // 1 while backpressure is engaged; see backpressure
+	inFlight   int64 // Points taken off the queue by posters and not yet written, spooled or given up on
+
+	// Guards the pause and flush signals, and the outcome of the last writes.
+	stateLock   sync.Mutex
+	resumed     chan struct{} // Non nil while paused; closed on resume
+	flushes     chan struct{} // Closed, and replaced, to ask posters to deliver now
+	lastSuccess time.Time
+	lastFailure time.Time
 }
 
 func newDestination(name string, chanCap int) *destination {
-	destination := &destination{Name: name}
+	destination := &destination{Name: name, flushes: make(chan struct{})}
 	destination.points = make(chan point, chanCap)
 	destination.depthGauge = metrics.GetOrRegisterGauge(
 		"lumbermill.points.pending."+name,
@@ -26,24 +45,134 @@ func newDestination(name string, chanCap int) *destination {
 	return destination
 }
 
-// Update depth guages every so often
+// Update depth guages every so often, until closed
 func (d *destination) Sample(every time.Duration) {
 	for {
 		time.Sleep(every)
 		d.depthGauge.Update(int64(len(d.points)))
+
+		d.closeLock.RLock()
+		closed := d.closed
+		d.closeLock.RUnlock()
+		if closed {
+			return
+		}
 	}
 }
 
-// Post the point, or increment a counter if channel is full
-func (d *destination) PostPoint(point point) {
+// Post the point. If the channel is full, spool it, or increment a counter if
+// there's no spool. Returns false if the point was dropped, including when
+// the destination has been closed.
+func (d *destination) PostPoint(point point) bool {
+	d.closeLock.RLock()
+	defer d.closeLock.RUnlock()
+	if d.closed {
+		droppedErrorCounter.Inc(1)
+		return false
+	}
+
 	select {
 	case d.points <- point:
 	default:
+		if d.spool != nil {
+			d.spool.AppendPoint(point)
+			return true
+		}
 		droppedErrorCounter.Inc(1)
+		return false
 	}
+	return true
+}
+
+// The number of points queued for delivery
+func (d *destination) Load() int64 {
+	return int64(len(d.points))
 }
 
+// Whether new points should be sent here, rather than failed over
+func (d *destination) Available() bool {
+	return d.breaker.Allow()
+}
+
+// Closes the points channel, so posters deliver what's queued and exit. It's
+// safe to call more than once. A paused destination is resumed so it can
+// drain.
 func (d *destination) Close() error {
-	close(d.points)
+	d.Resume()
+
+	d.closeLock.Lock()
+	defer d.closeLock.Unlock()
+	if !d.closed {
+		d.closed = true
+		close(d.points)
+	}
 	return nil
 }
+
+// Stops posters taking points off the queue, which fills up and then spools
+// or drops, until resumed.
+func (d *destination) Pause() {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	if d.resumed == nil {
+		d.resumed = make(chan struct{})
+	}
+}
+
+func (d *destination) Resume() {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	if d.resumed != nil {
+		close(d.resumed)
+		d.resumed = nil
+	}
+}
+
+func (d *destination) Paused() bool {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	return d.resumed != nil
+}
+
+// Blocks while the destination is paused, or until stop is closed.
+func (d *destination) waitWhilePaused(stop <-chan struct{}) {
+	d.stateLock.Lock()
+	resumed := d.resumed
+	d.stateLock.Unlock()
+
+	if resumed != nil {
+		select {
+		case <-resumed:
+		case <-stop:
+		}
+	}
+}
+
+// Asks posters to deliver what they've collected, including pending rollups,
+// without waiting for the next tick, and appends overflow points to the spool.
+func (d *destination) Flush() {
+	d.stateLock.Lock()
+	close(d.flushes)
+	d.flushes = make(chan struct{})
+	d.stateLock.Unlock()
+
+	d.spool.FlushOverflow()
+}
+
+// Closed on the next Flush.
+func (d *destination) flushed() <-chan struct{} {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	return d.flushes
+}
+
+// Records the outcome of a write to InfluxDB.
+func (d *destination) recordWrite(err error) {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	if err == nil {
+		d.lastSuccess = time.Now()
+	} else {
+		d.lastFailure = time.Now()
+	}
+}
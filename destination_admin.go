@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+var errUnknownAction = errors.New("unknown destination action")
+
+type destinationStatus struct {
+	Name          string           `json:"name"`
+	QueueDepth    int              `json:"queue_depth"`
+	QueueCapacity int              `json:"queue_capacity"`
+	InFlight      int64            `json:"in_flight"`
+	Posters       int              `json:"posters,omitempty"` // The null route has none
+	Paused        bool             `json:"paused"`
+	Circuit       string           `json:"circuit"`
+	LastSuccess   *time.Time       `json:"last_success,omitempty"`
+	LastFailure   *time.Time       `json:"last_failure,omitempty"`
+	Errors        map[string]int64 `json:"errors"` // By write error class
+}
+
+type destinationsResponse struct {
+	Destinations []destinationStatus `json:"destinations"`
+}
+
+type postersRequest struct {
+	Posters int `json:"posters"`
+}
+
+func newDestinationStatus(rt *route) destinationStatus {
+	d := rt.destination
+	status := destinationStatus{
+		Name:          d.Name,
+		QueueDepth:    len(d.points),
+		QueueCapacity: cap(d.points),
+		InFlight:      atomic.LoadInt64(&d.inFlight),
+		Posters:       len(rt.stops),
+		Paused:        d.Paused(),
+		Circuit:       d.breaker.State(),
+		Errors:        make(map[string]int64),
+	}
+
+	d.stateLock.Lock()
+	if !d.lastSuccess.IsZero() {
+		t := d.lastSuccess
+		status.LastSuccess = &t
+	}
+	if !d.lastFailure.IsZero() {
+		t := d.lastFailure
+		status.LastFailure = &t
+	}
+	d.stateLock.Unlock()
+
+	for c := writeErrorClass(0); c < numWriteErrorClasses; c++ {
+		status.Errors[c.Name()] = metrics.GetOrRegisterCounter("lumbermill.poster.error."+c.Name()+"."+d.Name, metrics.DefaultRegistry).Count()
+	}
+	return status
+}
+
+// The status of every destination, sorted by name, or of the named one.
+func (r *routes) Status(name string) ([]destinationStatus, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	var statuses []destinationStatus
+	for host, rt := range r.routes {
+		if name == "" || host == name {
+			statuses = append(statuses, newDestinationStatus(rt))
+		}
+	}
+	if r.null != nil && (name == "" || name == "null") {
+		statuses = append(statuses, newDestinationStatus(r.null))
+	}
+	if name != "" && len(statuses) == 0 {
+		return nil, errRouteNotFound
+	}
+
+	sort.Sort(destinationStatusesByName(statuses))
+	return statuses, nil
+}
+
+// Finds an InfluxDB host's destination.
+func (r *routes) destination(host string) (*destination, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	route, exists := r.routes[host]
+	if !exists {
+		return nil, errRouteNotFound
+	}
+	return route.destination, nil
+}
+
+type destinationStatusesByName []destinationStatus
+
+func (s destinationStatusesByName) Len() int           { return len(s) }
+func (s destinationStatusesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s destinationStatusesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// GET  /admin/destinations                lists every destination's queue, posters and health
+// GET  /admin/destinations/<host>         shows one destination
+// POST /admin/destinations/<host>/pause   stops delivering to it, queueing points instead
+// POST /admin/destinations/<host>/resume  starts delivering to it again
+// POST /admin/destinations/<host>/flush   delivers collected points and rollups now
+// POST /admin/destinations/<host>/posters changes its poster count with {"posters": n}
+func (s *server) serveDestinations(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/destinations"), "/")
+	host, action := path, ""
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		host, action = path[:i], path[i+1:]
+	}
+
+	var err error
+	switch {
+	case action == "" && r.Method == "GET":
+	case action != "" && host != "" && r.Method == "POST":
+		err = s.destinationAction(host, action, r)
+		if err == errUnknownAction {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		wrongMethodErrorCounter.Inc(1)
+		return
+	}
+
+	var statuses []destinationStatus
+	if err == nil {
+		statuses, err = s.routes.Status(host)
+	}
+
+	switch err {
+	case nil:
+	case errRouteNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errRoutesClosed:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		badRequestCounter.Inc(1)
+		return
+	}
+
+	if statuses == nil {
+		statuses = []destinationStatus{}
+	}
+	response, err := json.Marshal(destinationsResponse{Destinations: statuses})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		internalServerErrorCounter.Inc(1)
+		return
+	}
+
+	headers := w.Header()
+	headers.Set("Content-Length", fmt.Sprintf("%d", len(response)))
+	headers.Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func (s *server) destinationAction(host, action string, r *http.Request) error {
+	if action == "posters" {
+		var req postersRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+		return s.routes.SetPosters(host, req.Posters)
+	}
+
+	d, err := s.routes.destination(host)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "pause":
+		d.Pause()
+	case "resume":
+		d.Resume()
+	case "flush":
+		d.Flush()
+	default:
+		return errUnknownAction
+	}
+	logger.Info("destination-"+action, "destination", host)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+)
+
+func TestServeDestinations(t *testing.T) {
+	influxdb := setupInfluxDBTestServer(nil)
+	defer influxdb.Close()
+	host := extractHostPort(influxdb.URL)
+
+	routes := createMessageRoutes(host, newTestClientFunc)
+	defer routes.Close()
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, routes)
+
+	testCases := []struct {
+		method, path, body string
+		status             int
+		check              func(destinationStatus) bool
+	}{
+		{"GET", "/admin/destinations", "", http.StatusOK, func(d destinationStatus) bool {
+			return d.Name == host && d.Posters == postersPerHost && d.QueueCapacity == pointChannelCapacity && d.Circuit == "closed"
+		}},
+		{"POST", "/admin/destinations/" + host + "/pause", "", http.StatusOK, func(d destinationStatus) bool { return d.Paused }},
+		{"POST", "/admin/destinations/" + host + "/resume", "", http.StatusOK, func(d destinationStatus) bool { return !d.Paused }},
+		{"POST", "/admin/destinations/" + host + "/flush", "", http.StatusOK, nil},
+		{"POST", "/admin/destinations/" + host + "/posters", `{"posters": 2}`, http.StatusOK, func(d destinationStatus) bool { return d.Posters == 2 }},
+		{"POST", "/admin/destinations/" + host + "/posters", `{"posters": 0}`, http.StatusBadRequest, nil},
+		{"POST", "/admin/destinations/" + host + "/explode", "", http.StatusNotFound, nil},
+		{"POST", "/admin/destinations/nope:8086/pause", "", http.StatusNotFound, nil},
+		{"GET", "/admin/destinations/nope:8086", "", http.StatusNotFound, nil},
+		{"DELETE", "/admin/destinations/" + host, "", http.StatusMethodNotAllowed, nil},
+	}
+
+	for _, tc := range testCases {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest(tc.method, tc.path, bytes.NewReader([]byte(tc.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server.http.Handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.status {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.status, recorder.Code)
+			continue
+		}
+		if tc.check == nil {
+			continue
+		}
+
+		var resp destinationsResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Destinations) != 1 || !tc.check(resp.Destinations[0]) {
+			t.Errorf("%s %s: unexpected response %s", tc.method, tc.path, recorder.Body.String())
+		}
+	}
+}
+
+func TestPausedDestinationHoldsPoints(t *testing.T) {
+	var writes int32
+	influxdb := setupInfluxDBTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&writes, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer influxdb.Close()
+
+	routes := createMessageRoutes(extractHostPort(influxdb.URL), newTestClientFunc)
+	defer routes.Close()
+	d := routes.Destinations()[0]
+
+	// Flushing hands the posters' current batches back, so they see the pause.
+	d.Pause()
+	d.Flush()
+	d.PostPoint(point{Token: "token", Type: routerRequest, Points: []interface{}{int64(1), 200, 1, 1}})
+
+	time.Sleep(1500 * time.Millisecond)
+	if atomic.LoadInt32(&writes) != 0 || d.Load() != 1 {
+		t.Fatalf("Expected the point to stay queued while paused, writes=%d queued=%d", atomic.LoadInt32(&writes), d.Load())
+	}
+
+	d.Resume()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&writes) == 0 && time.Now().Before(deadline) {
+		d.Flush()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&writes) == 0 {
+		t.Error("Expected the point to be delivered once resumed")
+	}
+}
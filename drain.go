@@ -3,7 +3,6 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -40,6 +39,7 @@ var (
 	dynoErrorLinesCounter      = metrics.GetOrRegisterCounter("lumbermill.lines.dyno.error", metrics.DefaultRegistry)
 	dynoMemLinesCounter        = metrics.GetOrRegisterCounter("lumbermill.lines.dyno.mem", metrics.DefaultRegistry)
 	dynoLoadLinesCounter       = metrics.GetOrRegisterCounter("lumbermill.lines.dyno.load", metrics.DefaultRegistry)
+	scaleLinesCounter          = metrics.GetOrRegisterCounter("lumbermill.lines.api.scale", metrics.DefaultRegistry)
 	unknownHerokuLinesCounter  = metrics.GetOrRegisterCounter("lumbermill.lines.unknown.heroku", metrics.DefaultRegistry)
 	unknownUserLinesCounter    = metrics.GetOrRegisterCounter("lumbermill.lines.unknown.user", metrics.DefaultRegistry)
 	parseTimer                 = metrics.GetOrRegisterTimer("lumbermill.batches.parse.time", metrics.DefaultRegistry)
@@ -66,9 +66,35 @@ func (s *server) maybeUpdateRecentTokens(host, id string) {
 	}
 }
 
-func handleLogFmtParsingError(msg []byte, err error) {
+func handleLogFmtParsingError(span *span, token string, msg []byte, err error) {
 	logfmtParsingErrorCounter.Inc(1)
-	log.Printf("logfmt unmarshal error(%q): %q\n", string(msg), err)
+	span.AddEvent("logfmt-parse-error", "token", token, "err", err)
+	logger.Limited(parseErrorLog, levelWarn, "logfmt-parse", "token", token, "err", err, "line", msg)
+}
+
+// Applies the skew policy to the point, and hands it to the alerter, any taps
+// and, within the token's rate limit, the token's replicas. What happens to it
+// is counted on the request's span. Returns false if too few replicas
+// accepted it.
+func (s *server) postPoint(span *span, replicas []*destination, p point, received time.Time) bool {
+	if !s.skewPolicy.apply(&p, received) {
+		span.Count("points.skew_dropped", 1)
+		return true
+	}
+	s.alerter.Observe(p)
+	allowed := s.rateLimiter.AllowPoint(p.Token)
+	s.taps.Point(p, !allowed)
+	if !allowed {
+		span.Count("points.rate_limited", 1)
+		return true
+	}
+	p.Trace = span.Context()
+	if !postToReplicas(replicas, s.replicationFactor, p, s.writeConsistency) {
+		span.Count("points.dropped", 1)
+		return false
+	}
+	span.Count("points.posted", 1)
+	return true
 }
 
 // "Parse tree" from hell
@@ -86,12 +112,30 @@ func (s *server) serveDrain(w http.ResponseWriter, r *http.Request) {
 
 	id := r.Header.Get("Logplex-Drain-Token")
 
+	span := tracing.Start("drain", id)
+	defer span.End()
+	span.SetAttributes(
+		"lumbermill.token", id,
+		"logplex.frame_id", r.Header.Get("Logplex-Frame-Id"),
+		"logplex.msg_count", r.Header.Get("Logplex-Msg-Count"),
+	)
+
+	ring := s.routes.Ring()
+
+	// Push back before reading the batch, so the sender retries it.
+	if id != "" && s.backpressure.Reject(ring.GetN(id, s.replicationFactor), s.replicationFactor, s.writeConsistency) {
+		span.AddEvent("backpressure-rejected")
+		s.backpressure.respond(w)
+		return
+	}
+
 	batchCounter.Inc(1)
 
 	parseStart := time.Now()
 	lp := lpx.NewReader(bufio.NewReader(r.Body))
 
 	linesCounterInc := 0
+	shortfall := false
 
 	for lp.Next() {
 		linesCounterInc++
@@ -107,12 +151,19 @@ func (s *server) serveDrain(w http.ResponseWriter, r *http.Request) {
 		// If we still don't have an id, throw an error and try the next line
 		if id == "" {
 			tokenMissingCounter.Inc(1)
+			span.Count("lines.token_missing", 1)
+			continue
+		}
+
+		if !s.rateLimiter.AllowLine(id) {
+			span.Count("lines.rate_limited", 1)
 			continue
 		}
 
-		destination := s.hashRing.Get(id)
+		replicas := ring.GetN(id, s.replicationFactor)
 
 		msg := lp.Bytes()
+		s.taps.Line(id, header, msg)
 		switch {
 		case bytes.Equal(header.Name, Heroku), bytes.HasPrefix(header.Name, TokenPrefix):
 			timeStr := string(lp.Header().Time)
@@ -121,7 +172,8 @@ func (s *server) serveDrain(w http.ResponseWriter, r *http.Request) {
 				t, e = time.Parse("2006-01-02T15:04:05+00:00", timeStr)
 				if e != nil {
 					timeParsingErrorCounter.Inc(1)
-					log.Printf("Error Parsing Time(%s): %q\n", string(lp.Header().Time), e)
+					span.AddEvent("time-parse-error", "token", id, "err", e)
+					logger.Limited(parseErrorLog, levelWarn, "time-parse", "token", id, "err", e, "time", lp.Header().Time)
 					continue
 				}
 			}
@@ -139,7 +191,7 @@ func (s *server) serveDrain(w http.ResponseWriter, r *http.Request) {
 					re := routerError{}
 					err := logfmt.Unmarshal(msg, &re)
 					if err != nil {
-						handleLogFmtParsingError(msg, err)
+						handleLogFmtParsingError(span, id, msg, err)
 						continue
 					}
 
@@ -147,10 +199,12 @@ func (s *server) serveDrain(w http.ResponseWriter, r *http.Request) {
 					metrics.GetOrRegisterCounter("lumbermill.lines.router.errors."+re.Code, metrics.DefaultRegistry).Inc(1)
 
 					if debugToken != "" && id == debugToken {
-						log.Printf("debug=error.%s %s", re.Code, msg)
+						logger.Info("debug-token", "token", id, "code", re.Code, "line", msg)
 					}
 
-					destination.PostPoint(point{id, routerEvent, []interface{}{timestamp, re.Code}})
+					if !s.postPoint(span, replicas, point{Token: id, Type: routerEvent, Points: []interface{}{timestamp, re.Code}}, parseStart) {
+						shortfall = true
+					}
 
 					// If the app is blank (not pushed) we don't care
 				// do nothing atm, increment a counter
@@ -163,11 +217,19 @@ func (s *server) serveDrain(w http.ResponseWriter, r *http.Request) {
 					rm := routerMsg{}
 					err := logfmt.Unmarshal(msg, &rm)
 					if err != nil {
-						handleLogFmtParsingError(msg, err)
+						handleLogFmtParsingError(span, id, msg, err)
+						continue
+					}
+
+					rate, keep := s.sampler.Sample(id, rm.RequestID, rm.Status)
+					if !keep {
+						span.Count("points.sampled_out", 1)
 						continue
 					}
 
-					destination.PostPoint(point{id, routerRequest, []interface{}{timestamp, rm.Status, rm.Service}})
+					if !s.postPoint(span, replicas, point{Token: id, Type: routerRequest, Points: []interface{}{timestamp, rm.Status, rm.Service, rm.Connect, rate}}, parseStart) {
+						shortfall = true
+					}
 				}
 
 				// Non router logs, so either dynos, runtime, etc
@@ -178,32 +240,42 @@ func (s *server) serveDrain(w http.ResponseWriter, r *http.Request) {
 					dynoErrorLinesCounter.Inc(1)
 					de, err := parseBytesToDynoError(msg)
 					if err != nil {
-						handleLogFmtParsingError(msg, err)
+						handleLogFmtParsingError(span, id, msg, err)
 						continue
 					}
 
 					what := string(lp.Header().Procid)
-					destination.PostPoint(
-						point{id, dynoEvents, []interface{}{timestamp, what, "R", de.Code, string(msg), dynoType(what)}},
-					)
+					if !s.postPoint(
+						span,
+						replicas,
+						point{Token: id, Type: dynoEvents, Points: []interface{}{timestamp, what, "R", de.Code, string(msg), dynoType(what)}},
+						parseStart,
+					) {
+						shortfall = true
+					}
 
 				// Dyno log-runtime-metrics memory messages
 				case bytes.Contains(msg, dynoMemMsgSentinel):
-					s.maybeUpdateRecentTokens(destination.Name, id)
+					for _, destination := range replicas {
+						s.maybeUpdateRecentTokens(destination.Name, id)
+					}
 
 					dynoMemLinesCounter.Inc(1)
 					dm := dynoMemMsg{}
 					err := logfmt.Unmarshal(msg, &dm)
 					if err != nil {
-						handleLogFmtParsingError(msg, err)
+						handleLogFmtParsingError(span, id, msg, err)
 						continue
 					}
 					if dm.Source != "" {
-						destination.PostPoint(
+						pctOfQuota, r14ETA, r15ETA := s.memoryQuotas.ObserveMemory(id, dm.Source, t, dm.MemoryTotal)
+						if !s.postPoint(
+							span,
+							replicas,
 							point{
-								id,
-								dynoMem,
-								[]interface{}{
+								Token: id,
+								Type:  dynoMem,
+								Points: []interface{}{
 									timestamp,
 									dm.Source,
 									dm.MemoryCache,
@@ -213,71 +285,85 @@ func (s *server) serveDrain(w http.ResponseWriter, r *http.Request) {
 									dm.MemorySwap,
 									dm.MemoryTotal,
 									dynoType(dm.Source),
+									pctOfQuota,
+									r14ETA,
+									r15ETA,
 								},
 							},
-						)
+							parseStart,
+						) {
+							shortfall = true
+						}
 					}
 
 					// Dyno log-runtime-metrics load messages
 				case bytes.Contains(msg, dynoLoadMsgSentinel):
-					s.maybeUpdateRecentTokens(destination.Name, id)
+					for _, destination := range replicas {
+						s.maybeUpdateRecentTokens(destination.Name, id)
+					}
 
 					dynoLoadLinesCounter.Inc(1)
 					dm := dynoLoadMsg{}
 					err := logfmt.Unmarshal(msg, &dm)
 					if err != nil {
-						handleLogFmtParsingError(msg, err)
+						handleLogFmtParsingError(span, id, msg, err)
 						continue
 					}
 					if dm.Source != "" {
-						destination.PostPoint(
+						if !s.postPoint(
+							span,
+							replicas,
 							point{
-								id,
-								dynoLoad,
-								[]interface{}{timestamp, dm.Source, dm.LoadAvg1Min, dm.LoadAvg5Min, dm.LoadAvg15Min, dynoType(dm.Source)},
+								Token:  id,
+								Type:   dynoLoad,
+								Points: []interface{}{timestamp, dm.Source, dm.LoadAvg1Min, dm.LoadAvg5Min, dm.LoadAvg15Min, dynoType(dm.Source)},
 							},
-						)
+							parseStart,
+						) {
+							shortfall = true
+						}
 					}
 
 				// unknown
 				default:
 					unknownHerokuLinesCounter.Inc(1)
-					if debug {
-						log.Printf("Unknown Heroku Line - Header: PRI: %s, Time: %s, Hostname: %s, Name: %s, ProcId: %s, MsgId: %s - Body: %s",
-							header.PrivalVersion,
-							header.Time,
-							header.Hostname,
-							header.Name,
-							header.Procid,
-							header.Msgid,
-							string(msg),
-						)
+					span.Count("lines.unknown", 1)
+					if logger.Enabled(levelDebug) {
+						logger.Debug("unknown-line", "kind", "heroku", "token", id,
+							"pri", header.PrivalVersion, "time", header.Time, "hostname", header.Hostname,
+							"name", header.Name, "procid", header.Procid, "msgid", header.Msgid, "line", msg)
 					}
 				}
 			}
 
+		// Heroku API lines reporting formation changes, for dyno memory quotas
+		case bytes.Equal(header.Name, appName) && bytes.Equal(header.Procid, apiProcid) && bytes.HasPrefix(msg, scaleMsgSentinel):
+			scaleLinesCounter.Inc(1)
+			s.memoryQuotas.ObserveScale(id, msg)
+
 		// non heroku lines
 		default:
 			unknownUserLinesCounter.Inc(1)
-			if debug {
-				log.Printf("Unknown User Line - Header: PRI: %s, Time: %s, Hostname: %s, Name: %s, ProcId: %s, MsgId: %s - Body: %s",
-					header.PrivalVersion,
-					header.Time,
-					header.Hostname,
-					header.Name,
-					header.Procid,
-					header.Msgid,
-					string(msg),
-				)
+			span.Count("lines.unknown", 1)
+			if logger.Enabled(levelDebug) {
+				logger.Debug("unknown-line", "kind", "user", "token", id,
+					"pri", header.PrivalVersion, "time", header.Time, "hostname", header.Hostname,
+					"name", header.Name, "procid", header.Procid, "msgid", header.Msgid, "line", msg)
 			}
 		}
 	}
 
 	linesCounter.Inc(int64(linesCounterInc))
+	span.SetAttributes("lumbermill.lines", linesCounterInc)
 
 	batchSizeHistogram.Update(int64(linesCounterInc))
 
 	parseTimer.UpdateSince(parseStart)
 
+	if shortfall {
+		span.AddEvent("replication-insufficient")
+		s.respondShortfall(w)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	lpxgen "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/apg/lpxgen"
 	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
@@ -66,15 +67,14 @@ func TestLumbermillDrain(t *testing.T) {
 		}
 	}()
 
-	lumbermill, testServer, destinations, waitGroup := setupLumbermillTestServer(influxHost, "user:pass")
-	shutdownChan := make(shutdownChan)
+	lumbermill, testServer, routes := setupLumbermillTestServer(influxHost, "user:pass")
+	sent := make(chan struct{})
 
 	defer func() {
 		influxdb.Close()
 		testServer.Close()
 	}()
 
-	go lumbermill.awaitShutdown()
 	go func() {
 		client := &http.Client{
 			Transport: &http.Transport{
@@ -95,13 +95,9 @@ func TestLumbermillDrain(t *testing.T) {
 			}
 		}
 
-		// Shutdown by calling Close() on both shutdownChan and lumbermill
-		shutdownChan.Close()
-		lumbermill.Close()
-		for _, d := range destinations {
-			d.Close()
-		}
+		close(sent)
 	}()
 
-	awaitShutdown(shutdownChan, lumbermill, waitGroup)
+	<-sent
+	newLifecycle(lumbermill, routes, 0, 30*time.Second).Shutdown()
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	memoryTrendWindow  = 10 * time.Minute
+	memoryTrendSamples = 30
+	r15QuotaMultiple   = 2 // Dynos are killed with an R15 at this multiple of their quota
+)
+
+var (
+	// Memory quotas, in MB, by lower cased dyno size
+	defaultDynoSizes = map[string]float64{
+		"free":          512,
+		"hobby":         512,
+		"standard-1x":   512,
+		"standard-2x":   1024,
+		"performance-m": 2560,
+		"performance-l": 14336,
+		"private-s":     1024,
+		"private-m":     2560,
+		"private-l":     14336,
+	}
+
+	scaleMsgSentinel = []byte("Scaled to ")
+	appName          = []byte("app")
+	apiProcid        = []byte("api")
+	scaledBySep      = []byte(" by ")
+	formationSep     = []byte(" ")
+)
+
+type dynoKey struct {
+	token  string
+	source string
+}
+
+type memorySample struct {
+	t     time.Time
+	total float64
+}
+
+// Knows the memory quota of each dyno, from configuration or from the "Scaled
+// to" lines the Heroku API logs, and tracks the recent memory use of each dyno
+// to project when it will exceed its quota and start logging R14s, and when it
+// will exceed twice its quota and be killed with an R15.
+type memoryQuotaTracker struct {
+	sync.Mutex
+	sizes      map[string]float64           // dyno size -> MB
+	formations map[string]map[string]string // token -> dyno type -> dyno size
+	samples    map[dynoKey][]memorySample
+	lastPrune  time.Time
+}
+
+func newMemoryQuotaTracker(sizes map[string]float64, formations map[string]map[string]string) *memoryQuotaTracker {
+	return &memoryQuotaTracker{
+		sizes:      sizes,
+		formations: formations,
+		samples:    make(map[dynoKey][]memorySample),
+	}
+}
+
+// Configures the tracker from DYNO_SIZES ("standard-1x:512|custom:4096"),
+// which adds to or overrides the default sizes, and DYNO_FORMATIONS
+// ("token1:web=standard-2x,worker=performance-m|token2:web=performance-l").
+func newMemoryQuotaTrackerFromEnv() *memoryQuotaTracker {
+	sizes := make(map[string]float64)
+	for size, mb := range defaultDynoSizes {
+		sizes[size] = mb
+	}
+	for size, v := range parseKeyValueList(os.Getenv("DYNO_SIZES")) {
+		mb, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			logger.Warn("dyno-quota", "err", err, "size", size, "quota", v)
+			continue
+		}
+		sizes[strings.ToLower(size)] = mb
+	}
+
+	formations := make(map[string]map[string]string)
+	for token, v := range parseKeyValueList(os.Getenv("DYNO_FORMATIONS")) {
+		formations[token] = make(map[string]string)
+		for _, f := range strings.Split(v, ",") {
+			typeSize := strings.SplitN(f, "=", 2)
+			if len(typeSize) != 2 {
+				logger.Warn("dyno-quota", "err", "invalid formation", "token", token, "formation", f)
+				continue
+			}
+			formations[token][strings.TrimSpace(typeSize[0])] = strings.ToLower(strings.TrimSpace(typeSize[1]))
+		}
+	}
+
+	return newMemoryQuotaTracker(sizes, formations)
+}
+
+// Records the dyno sizes from a Heroku API scale line, e.g.
+// "Scaled to web@2:Standard-2X worker@1:Performance-M by user foo@example.com"
+func (m *memoryQuotaTracker) ObserveScale(token string, msg []byte) {
+	formation := bytes.TrimPrefix(msg, scaleMsgSentinel)
+	if i := bytes.Index(formation, scaledBySep); i >= 0 {
+		formation = formation[:i]
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, f := range bytes.Split(formation, formationSep) {
+		// web@2:Standard-2X
+		at := bytes.IndexByte(f, '@')
+		colon := bytes.IndexByte(f, ':')
+		if at <= 0 || colon <= at {
+			continue
+		}
+
+		if m.formations[token] == nil {
+			m.formations[token] = make(map[string]string)
+		}
+		m.formations[token][string(f[:at])] = strings.ToLower(string(f[colon+1:]))
+	}
+}
+
+// Returns the quota of the dyno in MB, or 0 if its size isn't known.
+func (m *memoryQuotaTracker) quota(token, source string) float64 {
+	size, ok := m.formations[token][dynoType(source)]
+	if !ok {
+		return 0
+	}
+	return m.sizes[size]
+}
+
+// Records a memory sample and returns the percentage of the dyno's quota in
+// use and the projected number of seconds until the quota, and twice the
+// quota, are exceeded, based on the trend of recent samples. Any is nil if it
+// can't be determined.
+func (m *memoryQuotaTracker) ObserveMemory(token, source string, t time.Time, total float64) (pctOfQuota, r14ETA, r15ETA interface{}) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := dynoKey{token, source}
+	samples := append(m.samples[key], memorySample{t, total})
+	for len(samples) > memoryTrendSamples || (len(samples) > 0 && t.Sub(samples[0].t) > memoryTrendWindow) {
+		samples = samples[1:]
+	}
+	m.samples[key] = samples
+
+	if t.Sub(m.lastPrune) > memoryTrendWindow {
+		for k, s := range m.samples {
+			if t.Sub(s[len(s)-1].t) > memoryTrendWindow {
+				delete(m.samples, k)
+			}
+		}
+		m.lastPrune = t
+	}
+
+	quota := m.quota(token, source)
+	if quota <= 0 {
+		return nil, nil, nil
+	}
+
+	pctOfQuota = total / quota * 100
+	slope := memoryTrend(samples)
+	return pctOfQuota, memoryETA(total, quota, slope), memoryETA(total, quota*r15QuotaMultiple, slope)
+}
+
+// Seconds until total reaches limit, growing at slope MB per second: 0 if it
+// already has, nil if it isn't growing.
+func memoryETA(total, limit, slope float64) interface{} {
+	if total >= limit {
+		return 0.0
+	}
+	if slope > 0 {
+		return (limit - total) / slope
+	}
+	return nil
+}
+
+// Least squares slope of the samples, in MB per second
+func memoryTrend(samples []memorySample) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+
+	var sumX, sumY, sumXY, sumXX float64
+	n := float64(len(samples))
+	for _, s := range samples {
+		x := s.t.Sub(samples[0].t).Seconds()
+		sumX += x
+		sumY += s.total
+		sumXY += x * s.total
+		sumXX += x * x
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
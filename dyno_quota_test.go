@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMemoryQuotaFromScaleEvents(t *testing.T) {
+	m := newMemoryQuotaTracker(defaultDynoSizes, make(map[string]map[string]string))
+	now := time.Now()
+
+	if pct, eta, _ := m.ObserveMemory("foo", "web.1", now, 256); pct != nil || eta != nil {
+		t.Errorf("Expected unknown quota before any scale events, got pct=%v eta=%v", pct, eta)
+	}
+
+	m.ObserveScale("foo", []byte("Scaled to web@2:Standard-2X worker@1:Performance-M by user foo@example.com"))
+
+	if pct, _, _ := m.ObserveMemory("foo", "web.1", now, 512); pct != 50.0 {
+		t.Errorf("Expected web.1 to be at 50%% of quota, got %v", pct)
+	}
+	if pct, _, _ := m.ObserveMemory("foo", "worker.1", now, 256); pct != 10.0 {
+		t.Errorf("Expected worker.1 to be at 10%% of quota, got %v", pct)
+	}
+	if pct, _, _ := m.ObserveMemory("bar", "web.1", now, 256); pct != nil {
+		t.Errorf("Expected unknown quota for another token, got %v", pct)
+	}
+}
+
+func TestMemoryQuotaR14Projection(t *testing.T) {
+	m := newMemoryQuotaTracker(defaultDynoSizes, map[string]map[string]string{"foo": {"web": "standard-1x"}})
+	start := time.Now()
+
+	// Growing 1MB a second from 400MB.
+	var eta, r15 interface{}
+	for i := 0; i < 10; i++ {
+		_, eta, r15 = m.ObserveMemory("foo", "web.1", start.Add(time.Duration(i)*time.Second), 400+float64(i))
+	}
+
+	// 409MB now, 103MB to go to the quota and 615MB to twice it.
+	if f, ok := eta.(float64); !ok || math.Abs(f-103) > 1e-6 {
+		t.Errorf("Expected R14 in 103s, got %v", eta)
+	}
+	if f, ok := r15.(float64); !ok || math.Abs(f-615) > 1e-6 {
+		t.Errorf("Expected R15 in 615s, got %v", r15)
+	}
+
+	// Shrinking, so no projection.
+	_, eta, r15 = m.ObserveMemory("foo", "web.1", start.Add(20*time.Second), 100)
+	if eta != nil || r15 != nil {
+		t.Errorf("Expected no projection for shrinking memory, got %v and %v", eta, r15)
+	}
+
+	// Already over quota.
+	if _, eta, _ = m.ObserveMemory("foo", "web.1", start.Add(30*time.Second), 600); eta != 0.0 {
+		t.Errorf("Expected R14 now, got %v", eta)
+	}
+
+	// And over twice the quota.
+	if _, _, r15 = m.ObserveMemory("foo", "web.1", start.Add(40*time.Second), 1100); r15 != 0.0 {
+		t.Errorf("Expected R15 now, got %v", r15)
+	}
+}
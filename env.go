@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns the duration in the named environment variable, or def if it is
+// unset or can't be parsed.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Warn("env", "err", err, "name", name, "value", v, "default", def)
+		return def
+	}
+	return d
+}
+
+// Returns the integer in the named environment variable, or def if it is
+// unset or can't be parsed.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		logger.Warn("env", "err", err, "name", name, "value", v, "default", def)
+		return def
+	}
+	return i
+}
+
+// Returns the float in the named environment variable, or def if it is
+// unset or can't be parsed.
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		logger.Warn("env", "err", err, "name", name, "value", v, "default", def)
+		return def
+	}
+	return f
+}
+
+// Parses "key1:value1|key2:value2" style strings, the same format used by
+// CRED_STORE, into a map.
+func parseKeyValueList(s string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, "|") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			logger.Warn("env", "err", "missing value", "pair", pair)
+			continue
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return m
+}
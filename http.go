@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"sync"
 	"time"
@@ -23,11 +22,23 @@ var healthCheckClients = make(map[string]*influx.Client)
 type server struct {
 	sync.WaitGroup
 	connectionCloser chan struct{}
-	hashRing         *hashRing
+	routes           *routes
 	http             *http.Server
-	shutdownChan     shutdownChan
-	isShuttingDown   bool
+	shuttingDown     chan struct{} // Closed once shutdown begins
+	shutdownOnce     sync.Once
 	credStore        map[string]string
+	skewPolicy       *skewPolicy
+	alerter          *alerter
+	memoryQuotas     *memoryQuotaTracker
+	backpressure     *backpressure  // nil unless drains are rejected while destinations are overloaded
+	rateLimiter      *rateLimiter   // nil unless tokens are rate limited
+	sampler          *routerSampler // nil unless router requests are sampled
+	taps             *tapHub
+
+	// Each token's points are written to this many destinations, and must be
+	// accepted by writeConsistency of them.
+	replicationFactor int
+	writeConsistency  writeConsistency
 
 	// scheduler based sampling lock for writing to recentTokens
 	tokenLock        *int32
@@ -35,18 +46,28 @@ type server struct {
 	recentTokens     map[string]string
 }
 
-func newServer(httpServer *http.Server, ath auth.Authenticater, hashRing *hashRing) *server {
+// Drains, and the endpoints clients use, are authenticated with ath. Admin,
+// tap and metrics endpoints are authenticated with adminAth.
+func newServer(httpServer *http.Server, ath, adminAth auth.Authenticater, routes *routes) *server {
 	s := &server{
-		connectionCloser: make(chan struct{}),
-		shutdownChan:     make(chan struct{}),
+		connectionCloser: make(chan struct{}, 1),
+		shuttingDown:     make(chan struct{}),
 		http:             httpServer,
-		hashRing:         hashRing,
+		routes:           routes,
 		credStore:        make(map[string]string),
+		skewPolicy:       newSkewPolicyFromEnv(),
+		memoryQuotas:     newMemoryQuotaTrackerFromEnv(),
+		backpressure:     newBackpressureFromEnv(),
+		rateLimiter:      newRateLimiterFromEnv(),
+		sampler:          newRouterSamplerFromEnv(),
+		taps:             newTapHubFromEnv(),
 		tokenLock:        new(int32),
 		recentTokensLock: new(sync.RWMutex),
 		recentTokens:     make(map[string]string),
 	}
 
+	s.replicationFactor, s.writeConsistency = replicationFromEnv()
+
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/drain", auth.WrapAuth(ath,
@@ -57,22 +78,59 @@ func newServer(httpServer *http.Server, ath auth.Authenticater, hashRing *hashRi
 
 	mux.HandleFunc("/health", s.serveHealth)
 	mux.HandleFunc("/health/influxdb", auth.WrapAuth(ath, s.serveInfluxDBHealth))
+	mux.HandleFunc("/target", auth.WrapAuth(ath, s.serveTargets))
 	mux.HandleFunc("/target/", auth.WrapAuth(ath, s.serveTarget))
+	mux.HandleFunc("/tap/", auth.WrapAuth(adminAth, s.serveTap))
+	mux.HandleFunc("/sketch/merge", auth.WrapAuth(ath, s.serveSketchMerge))
+	mux.HandleFunc("/admin/ring", auth.WrapAuth(adminAth, s.serveRing))
+	mux.HandleFunc("/admin/ring/", auth.WrapAuth(adminAth, s.serveRing))
+	mux.HandleFunc("/admin/destinations", auth.WrapAuth(adminAth, s.serveDestinations))
+	mux.HandleFunc("/admin/destinations/", auth.WrapAuth(adminAth, s.serveDestinations))
+	mux.HandleFunc("/admin/ratelimits", auth.WrapAuth(adminAth, s.serveRateLimits))
+	mux.HandleFunc("/admin/ratelimits/", auth.WrapAuth(adminAth, s.serveRateLimits))
+	mux.HandleFunc("/admin/loglevel", auth.WrapAuth(adminAth, s.serveLogLevel))
+	mux.HandleFunc("/metrics", auth.WrapAuth(adminAth, s.serveMetrics))
 
 	s.http.Handler = mux
 
 	return s
 }
 
-func (s *server) Close() error {
-	s.shutdownChan <- struct{}{}
-	return nil
+// Starts failing health checks and closing connections after each drain. It's
+// safe to call more than once.
+func (s *server) beginShutdown() {
+	s.shutdownOnce.Do(func() {
+		logger.Info("shutdown", "msg", "shutting down")
+		close(s.shuttingDown)
+	})
 }
 
+func (s *server) isShuttingDown() bool {
+	select {
+	case <-s.shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Every so often, asks the next drain request to close its connection, so
+// clients reconnect and are rebalanced across lumbermills. A recycle nobody
+// has picked up yet isn't queued twice.
 func (s *server) scheduleConnectionRecycling(after time.Duration) {
-	for !s.isShuttingDown {
-		time.Sleep(after)
-		s.connectionCloser <- struct{}{}
+	ticker := time.NewTicker(after)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shuttingDown:
+			return
+		case <-ticker.C:
+			select {
+			case s.connectionCloser <- struct{}{}:
+			default:
+			}
+		}
 	}
 }
 
@@ -81,26 +139,32 @@ func (s *server) recycleConnection(w http.ResponseWriter) {
 	case <-s.connectionCloser:
 		w.Header().Set("Connection", "close")
 	default:
-		if s.isShuttingDown {
+		if s.isShuttingDown() {
 			w.Header().Set("Connection", "close")
 		}
 	}
 }
 
 func (s *server) Run(connRecycle time.Duration) {
-	go s.awaitShutdown()
 	go s.scheduleConnectionRecycling(connRecycle)
 
-	if err := s.http.ListenAndServe(); err != nil {
-		log.Fatalln("Unable to start HTTP server: ", err)
+	if err := s.http.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Fatal("http", "err", err, "msg", "unable to start HTTP server")
 	}
 }
 
-// Serves a 200 OK, unless shutdown has been requested.
+// Serves a 200 OK, unless shutdown has been requested or destinations are
+// overloaded.
 // Shutting down serves a 503 since that's how ELBs implement connection draining.
 func (s *server) serveHealth(w http.ResponseWriter, r *http.Request) {
-	if s.isShuttingDown {
+	if s.isShuttingDown() {
 		http.Error(w, "Shutting Down", 503)
+		return
+	}
+
+	if s.backpressure != nil && s.backpressure.Overloaded(s.routes.Destinations()) {
+		http.Error(w, "Overloaded", 503)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -116,7 +180,7 @@ func getHealthCheckClient(host string, f clientFunc) (*influx.Client, error) {
 		clientConfig := createInfluxDBClient(host, f)
 		client, err = influx.NewClient(&clientConfig)
 		if err != nil {
-			log.Printf("err=%q at=getHealthCheckClient host=%q", err, host)
+			logger.Error("influxdb-health", "destination", host, "err", err)
 			return nil, err
 		}
 
@@ -154,12 +218,22 @@ func (s *server) checkRecentTokens() []error {
 
 	wg := new(sync.WaitGroup)
 
-	s.recentTokensLock.RLock()
+	// Forget hosts that have been removed from the ring
+	current := make(map[string]bool)
+	for _, d := range s.routes.Destinations() {
+		current[d.Name] = true
+	}
+
+	s.recentTokensLock.Lock()
 	tokenMap := make(map[string]string)
 	for host, token := range s.recentTokens {
+		if !current[host] {
+			delete(s.recentTokens, host)
+			continue
+		}
 		tokenMap[host] = token
 	}
-	s.recentTokensLock.RUnlock()
+	s.recentTokensLock.Unlock()
 
 	errors := make(chan error, len(tokenMap)*len(influxDbSeriesCheckQueries))
 
@@ -192,15 +266,9 @@ func (s *server) serveInfluxDBHealth(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		for _, err := range errors {
 			w.Write([]byte(err.Error() + "\n"))
-			log.Println(err)
+			logger.Error("influxdb-health", "err", err)
 		}
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
-
-func (s *server) awaitShutdown() {
-	<-s.shutdownChan
-	log.Printf("Shutting down.")
-	s.isShuttingDown = true
-}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+
+	// How long posters still writing at the timeout get to finish, once what
+	// they hadn't taken off the queue has been spooled.
+	shutdownPosterGrace = time.Second
+)
+
+// Shuts lumbermill down in order, so as little as possible is lost:
+//
+//  1. /health fails, so load balancers stop sending new drains.
+//  2. After deregistrationDelay, the HTTP server stops accepting connections
+//     and waits for in flight drains to finish.
+//  3. Destinations are closed, and posters deliver what's queued.
+//  4. Spools replay what they can, keep the rest on disk and are closed once
+//     their destination's posters are done with them.
+//
+// Steps 2 to 4 share timeout. Points still queued when it expires are spooled
+// if the destination has a spool, and reported lost otherwise. Posters then
+// get shutdownPosterGrace to finish their writes; points they're still
+// writing after that are reported lost, and spools are left open for them.
+type lifecycle struct {
+	server              *server
+	routes              *routes
+	deregistrationDelay time.Duration
+	timeout             time.Duration
+}
+
+// What happened to queued points during shutdown
+type shutdownReport struct {
+	TimedOut bool
+	Spooled  int // Queued points spooled once the timeout expired
+	Lost     int // Queued points with nowhere to go once the timeout expired, and points posters were still writing after the grace
+	Pending  int // Points left in spools for the next start
+}
+
+func newLifecycle(server *server, routes *routes, deregistrationDelay, timeout time.Duration) *lifecycle {
+	return &lifecycle{
+		server:              server,
+		routes:              routes,
+		deregistrationDelay: deregistrationDelay,
+		timeout:             timeout,
+	}
+}
+
+// Configures shutdown from SHUTDOWN_DEREGISTRATION_DELAY and SHUTDOWN_TIMEOUT.
+func newLifecycleFromEnv(server *server, routes *routes) *lifecycle {
+	return newLifecycle(server, routes,
+		envDuration("SHUTDOWN_DEREGISTRATION_DELAY", 0),
+		envDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+	)
+}
+
+func (l *lifecycle) Shutdown() shutdownReport {
+	var report shutdownReport
+	start := time.Now()
+
+	l.server.beginShutdown()
+	if l.deregistrationDelay > 0 {
+		logger.Info("shutdown", "msg", "waiting for deregistration", "delay", l.deregistrationDelay)
+		time.Sleep(l.deregistrationDelay)
+	}
+	deadline := time.Now().Add(l.timeout)
+
+	logger.Info("shutdown", "msg", "waiting for inflight requests to finish")
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := l.server.http.Shutdown(ctx); err != nil {
+		logger.Error("shutdown", "err", err)
+	}
+	// Drains served by something other than server.http, like tests' servers.
+	if !waitUntil(l.server.Wait, deadline) {
+		report.TimedOut = true
+	}
+
+	logger.Info("shutdown", "msg", "waiting for queues to drain")
+	l.routes.Close()
+	if !waitUntil(l.routes.Wait, deadline) {
+		report.TimedOut = true
+	}
+
+	destinations := l.routes.Destinations()
+	postersDone := true
+	if report.TimedOut {
+		for _, d := range destinations {
+			spooled, lost := spillQueue(d)
+			report.Spooled += spooled
+			report.Lost += lost
+		}
+
+		// Posters spool what they fail to write, so spools can't be closed
+		// under them.
+		if postersDone = waitUntil(l.routes.Wait, time.Now().Add(shutdownPosterGrace)); !postersDone {
+			for _, d := range destinations {
+				report.Lost += int(atomic.LoadInt64(&d.inFlight))
+			}
+			logger.Warn("shutdown", "msg", "posters still writing, leaving spools open")
+		}
+	}
+
+	for _, d := range destinations {
+		if err := d.spool.Flush(deadline); err != nil {
+			logger.Warn("shutdown", "destination", d.Name, "err", err)
+		}
+		report.Pending += d.spool.Pending()
+		if postersDone {
+			d.spool.Close()
+		}
+	}
+
+	logger.Info("shutdown", "timed_out", report.TimedOut, "points_spooled", report.Spooled,
+		"points_lost", report.Lost, "points_pending", report.Pending, "duration", time.Since(start))
+	return report
+}
+
+// Takes whatever the destination's posters didn't get to off its queue,
+// spooling it if possible. Only called once the destination is closed.
+// Posters may still be writing what they took.
+func spillQueue(d *destination) (spooled, lost int) {
+	if d.Name == "null" {
+		return 0, 0
+	}
+
+	for p := range d.points {
+		if d.spool != nil {
+			d.spool.AppendPoint(p)
+			spooled++
+		} else {
+			lost++
+		}
+	}
+	return spooled, lost
+}
+
+// Calls wait, returning false if it hasn't returned by the deadline.
+func waitUntil(wait func(), deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+)
+
+func TestHealthFailsOnceShuttingDown(t *testing.T) {
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, newRoutes(newTestClientFunc))
+	server.beginShutdown()
+	server.beginShutdown()
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/health", nil)
+	server.http.Handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Body.String() != "Shutting Down\n" {
+		t.Errorf("Expected a single 503, got %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestShutdownReportsQueuedPointsAfterTimeout(t *testing.T) {
+	// Nothing listens on port 1, so the poster is still retrying at the timeout.
+	routes := createMessageRoutes("127.0.0.1:1", newTestClientFunc)
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, routes)
+
+	d := routes.Destinations()[0]
+	for i := 0; i < 100; i++ {
+		d.PostPoint(point{Token: "token", Type: routerRequest, Points: []interface{}{int64(i), 200, 1, 1}})
+	}
+
+	start := time.Now()
+	report := newLifecycle(server, routes, 0, 200*time.Millisecond).Shutdown()
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Expected shutdown to give up after its timeout, took %s", time.Since(start))
+	}
+	if !report.TimedOut || report.Lost == 0 {
+		t.Errorf("Expected queued points to be reported lost, got %+v", report)
+	}
+	if !server.isShuttingDown() {
+		t.Error("Expected the server to be shutting down")
+	}
+}
+
+func TestShutdownLeavesSpoolsOpenForPosters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lumbermill-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("SPOOL_DIR", dir)
+	defer os.Unsetenv("SPOOL_DIR")
+
+	routes := createMessageRoutes("127.0.0.1:1", newTestClientFunc)
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, routes)
+
+	d := routes.Destinations()[0]
+	for i := 0; i < 100; i++ {
+		d.PostPoint(point{Token: "token", Type: routerRequest, Points: []interface{}{int64(i), 200, 1, 1}})
+	}
+
+	report := newLifecycle(server, routes, 0, 200*time.Millisecond).Shutdown()
+	if !report.TimedOut {
+		t.Fatalf("Expected shutdown to time out, got %+v", report)
+	}
+
+	// The poster is still retrying, and spools what it gives up on.
+	if err := d.spool.Append(testBatch("late")); err != nil {
+		t.Errorf("Expected the spool to stay open while posters are writing, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+// Queues shorter than this are never considered overloaded, so a mostly idle
+// ring doesn't move tokens around.
+const minBoundedLoad = 1000
+
+var (
+	overflowCounter      = metrics.GetOrRegisterCounter("lumbermill.ring.overflow", metrics.DefaultRegistry)
+	maxLoadPctOfAvgGauge = metrics.GetOrRegisterGauge("lumbermill.ring.load.max_pct_of_avg", metrics.DefaultRegistry)
+)
+
+// Each destination's load as a percentage of the average load, and the
+// highest of those. Everything is 100% when the ring is idle.
+func loadBalance(destinations []*destination) (map[string]int64, int64) {
+	var total int64
+	for _, d := range destinations {
+		total += d.Load()
+	}
+
+	pcts := make(map[string]int64)
+	var max int64
+	for _, d := range destinations {
+		pct := int64(100)
+		if total > 0 {
+			pct = d.Load() * 100 * int64(len(destinations)) / total
+		}
+		pcts[d.Name] = pct
+		if pct > max {
+			max = pct
+		}
+	}
+	return pcts, max
+}
+
+// Reports how evenly load is spread across the ring every so often.
+func (r *routes) SampleLoad(every time.Duration) {
+	for {
+		time.Sleep(every)
+
+		pcts, max := loadBalance(r.Destinations())
+		for name, pct := range pcts {
+			metrics.GetOrRegisterGauge("lumbermill.ring.load.pct_of_avg."+name, metrics.DefaultRegistry).Update(pct)
+		}
+		maxLoadPctOfAvgGauge.Update(max)
+	}
+}
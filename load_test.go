@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func fillDestination(d *destination, n int) {
+	for i := 0; i < n; i++ {
+		d.PostPoint(point{Token: "token", Type: routerRequest})
+	}
+}
+
+func TestHashRingBoundsLoad(t *testing.T) {
+	hash := newHashRing(3, func(key []byte) uint32 {
+		i, err := strconv.Atoi(string(key))
+		if err != nil {
+			panic(err)
+		}
+		return uint32(i)
+	})
+	hash.loadBound = 0.25
+
+	two := newDestination("2", 10*minBoundedLoad)
+	four := newDestination("4", 10*minBoundedLoad)
+	six := newDestination("6", 10*minBoundedLoad)
+	hash.Add(six, four, two)
+
+	// Short queues are never overloaded.
+	fillDestination(four, minBoundedLoad)
+	if hash.Get("3") != four {
+		t.Fatalf("Expected 3 to map to 4")
+	}
+
+	// 4 is now well above 1.25x the average, so 3 overflows to 6.
+	fillDestination(four, 2*minBoundedLoad)
+	fillDestination(six, minBoundedLoad)
+	before := overflowCounter.Count()
+	if hash.Get("3") != six {
+		t.Errorf("Expected 3 to overflow to 6 while 4 is overloaded")
+	}
+	if overflowCounter.Count()-before != 1 {
+		t.Errorf("Expected the overflow to be counted")
+	}
+
+	// Unbounded rings ignore load.
+	hash.loadBound = 0
+	if hash.Get("3") != four {
+		t.Errorf("Expected 3 to map to 4 when loads aren't bounded")
+	}
+}
+
+func TestLoadBalance(t *testing.T) {
+	busy := newDestination("busy", 100)
+	idle := newDestination("idle", 100)
+
+	pcts, max := loadBalance([]*destination{busy, idle})
+	if pcts["busy"] != 100 || pcts["idle"] != 100 || max != 100 {
+		t.Errorf("Expected an idle ring to be balanced, got %v", pcts)
+	}
+
+	fillDestination(busy, 30)
+	fillDestination(idle, 10)
+	pcts, max = loadBalance([]*destination{busy, idle})
+	if pcts["busy"] != 150 || pcts["idle"] != 50 || max != 150 {
+		t.Errorf("Expected 150%% and 50%%, got %v", pcts)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+const defaultParseErrorLogRate = 1 // Lines per second
+
+var (
+	logLevelNames = []string{"debug", "info", "warn", "error"}
+
+	logSuppressedCounter = metrics.GetOrRegisterCounter("lumbermill.log.suppressed", metrics.DefaultRegistry)
+
+	logger = newLoggerFromEnv(os.Stderr)
+
+	// Per line parse errors, so a malformed drain can't flood the logs
+	parseErrorLog = newLogLimiter(envFloat("LOG_PARSE_ERROR_RATE", defaultParseErrorLogRate), 10*time.Second)
+)
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if n == strings.ToLower(name) {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// Writes one JSON object per line: the time, level and what happened ("at"),
+// then key value pairs. Keys are shared across the code base: token,
+// destination, series, class (of write error) and err.
+type structuredLogger struct {
+	sync.Mutex // Serialises writes
+	out        io.Writer
+	level      int32
+	now        func() time.Time
+}
+
+func newLogger(out io.Writer, level logLevel) *structuredLogger {
+	return &structuredLogger{out: out, level: int32(level), now: time.Now}
+}
+
+// Logs at LOG_LEVEL, or debug if DEBUG is true, defaulting to info.
+func newLoggerFromEnv(out io.Writer) *structuredLogger {
+	level := levelInfo
+	if os.Getenv("DEBUG") == "true" {
+		level = levelDebug
+	}
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		l, err := parseLogLevel(v)
+		if err != nil {
+			fmt.Fprintf(out, "{\"level\":\"error\",\"at\":\"logger\",\"err\":%q}\n", err)
+		} else {
+			level = l
+		}
+	}
+	return newLogger(out, level)
+}
+
+func (l *structuredLogger) Level() logLevel {
+	return logLevel(atomic.LoadInt32(&l.level))
+}
+
+func (l *structuredLogger) SetLevel(level logLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Whether lines at level are written. Check it before building expensive
+// debug lines.
+func (l *structuredLogger) Enabled(level logLevel) bool {
+	return level >= l.Level()
+}
+
+func (l *structuredLogger) Debug(at string, kv ...interface{}) { l.log(levelDebug, at, kv) }
+func (l *structuredLogger) Info(at string, kv ...interface{})  { l.log(levelInfo, at, kv) }
+func (l *structuredLogger) Warn(at string, kv ...interface{})  { l.log(levelWarn, at, kv) }
+func (l *structuredLogger) Error(at string, kv ...interface{}) { l.log(levelError, at, kv) }
+
+// Logs an error and exits.
+func (l *structuredLogger) Fatal(at string, kv ...interface{}) {
+	l.log(levelError, at, kv)
+	os.Exit(1)
+}
+
+// Logs at level if the limiter allows it, noting how many lines it
+// suppressed since the last one.
+func (l *structuredLogger) Limited(limiter *logLimiter, level logLevel, at string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	ok, suppressed := limiter.allow()
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		kv = append(kv, "suppressed", suppressed)
+	}
+	l.log(level, at, kv)
+}
+
+func (l *structuredLogger) log(level logLevel, at string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeLogValue(&b, l.now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeLogValue(&b, level.String())
+	b.WriteString(`,"at":`)
+	writeLogValue(&b, at)
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(',')
+		writeLogValue(&b, fmt.Sprint(kv[i]))
+		b.WriteByte(':')
+		if i+1 < len(kv) {
+			writeLogValue(&b, kv[i+1])
+		} else {
+			b.WriteString("null")
+		}
+	}
+	b.WriteString("}\n")
+
+	l.Lock()
+	defer l.Unlock()
+	l.out.Write(b.Bytes())
+}
+
+func writeLogValue(b *bytes.Buffer, v interface{}) {
+	switch t := v.(type) {
+	case error:
+		v = t.Error()
+	case time.Duration:
+		v = t.String()
+	case []byte:
+		v = string(t)
+	case fmt.Stringer:
+		v = t.String()
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(encoded)
+}
+
+// Limits how often a kind of line is logged, counting what it suppresses.
+type logLimiter struct {
+	sync.Mutex
+	bucket     *tokenBucket
+	suppressed int64
+}
+
+func newLogLimiter(rate float64, burst time.Duration) *logLimiter {
+	return &logLimiter{bucket: newTokenBucket(rate, burst, time.Now())}
+}
+
+// Whether a line can be logged now and, if so, how many were suppressed
+// since the last one.
+func (ll *logLimiter) allow() (bool, int64) {
+	ll.Lock()
+	defer ll.Unlock()
+
+	if !ll.bucket.take(time.Now()) {
+		ll.suppressed++
+		logSuppressedCounter.Inc(1)
+		return false, 0
+	}
+	suppressed := ll.suppressed
+	ll.suppressed = 0
+	return true, suppressed
+}
+
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// GET /admin/loglevel
+// PUT /admin/loglevel with {"level": "debug"}
+func (s *server) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var req logLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			badRequestCounter.Inc(1)
+			return
+		}
+		level, err := parseLogLevel(req.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			badRequestCounter.Inc(1)
+			return
+		}
+		logger.SetLevel(level)
+		logger.Info("log-level", "level", level)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		wrongMethodErrorCounter.Inc(1)
+		return
+	}
+
+	response, err := json.Marshal(logLevelRequest{Level: logger.Level().String()})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		internalServerErrorCounter.Inc(1)
+		return
+	}
+
+	headers := w.Header()
+	headers.Set("Content-Length", fmt.Sprintf("%d", len(response)))
+	headers.Set("Content-Type", "application/json")
+	w.Write(response)
+}
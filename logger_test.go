@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+)
+
+func TestStructuredLogger(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(&out, levelInfo)
+	l.now = func() time.Time { return time.Unix(0, 0) }
+
+	l.Debug("hidden", "token", "t.a")
+	l.Warn("poster", "destination", "influx1:8086", "points", 2, "err", errors.New("boom"), "duration", time.Second, "line", []byte("a=1"))
+
+	expected := `{"time":"1970-01-01T00:00:00Z","level":"warn","at":"poster","destination":"influx1:8086","points":2,"err":"boom","duration":"1s","line":"a=1"}` + "\n"
+	if out.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, out.String())
+	}
+
+	out.Reset()
+	l.SetLevel(levelDebug)
+	l.Debug("shown", "dangling")
+	if !strings.Contains(out.String(), `"at":"shown","dangling":null}`) {
+		t.Errorf("Expected the debug line, got %s", out.String())
+	}
+}
+
+func TestLimitedLogging(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(&out, levelInfo)
+	limiter := newLogLimiter(1, time.Second)
+
+	for i := 0; i < 5; i++ {
+		l.Limited(limiter, levelWarn, "logfmt-parse", "token", "t.a")
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 1 {
+		t.Fatalf("Expected 1 line, got %d: %s", lines, out.String())
+	}
+
+	// Once the bucket refills, the next line reports what was suppressed.
+	limiter.bucket.tokens = 1
+	out.Reset()
+	l.Limited(limiter, levelWarn, "logfmt-parse", "token", "t.a")
+	if !strings.Contains(out.String(), `"suppressed":4`) {
+		t.Errorf("Expected 4 suppressed lines, got %s", out.String())
+	}
+}
+
+func TestServeLogLevel(t *testing.T) {
+	defer logger.SetLevel(logger.Level())
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, newRoutes(newTestClientFunc))
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/admin/loglevel", strings.NewReader(`{"level":"debug"}`))
+	server.http.Handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"level":"debug"}` {
+		t.Errorf("Unexpected response %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if !logger.Enabled(levelDebug) {
+		t.Error("Expected debug logging to be enabled")
+	}
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/admin/loglevel", strings.NewReader(`{"level":"loud"}`))
+	server.http.Handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 400 for an unknown level, got %d", recorder.Code)
+	}
+}
@@ -2,24 +2,19 @@ package main
 
 import (
 	"crypto/tls"
-	"io"
-	"log"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
 	influx "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/influxdb/influxdb-go"
 	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
-	librato "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics/librato"
 )
 
-type shutdownChan chan struct{}
-
 type clientFunc func() *http.Client
 
 const (
@@ -29,16 +24,6 @@ const (
 	postersPerHost       = 6
 )
 
-var (
-	connectionCloser = make(chan struct{})
-	debug            = os.Getenv("DEBUG") == "true"
-)
-
-func (s shutdownChan) Close() error {
-	s <- struct{}{}
-	return nil
-}
-
 func createInfluxDBClient(host string, f clientFunc) influx.ClientConfig {
 	return influx.ClientConfig{
 		Host:       host,                       //"influxor.ssl.edward.herokudev.com:8086",
@@ -64,55 +49,35 @@ func createClients(hostlist string, f clientFunc) []influx.ClientConfig {
 }
 
 // Creates destinations and attaches them to posters, which deliver to InfluxDB
-func createMessageRoutes(hostlist string, f clientFunc) (*hashRing, []*destination, *sync.WaitGroup) {
-	var destinations []*destination
-	posterGroup := new(sync.WaitGroup)
-	hashRing := newHashRing(hashRingReplication, nil)
-
-	influxClients := createClients(hostlist, f)
-	if len(influxClients) == 0 {
-		//No backends, so blackhole things
-		destination := newDestination("null", pointChannelCapacity)
-		hashRing.Add(destination)
-		destinations = append(destinations, destination)
-		poster := newNullPoster(destination)
-		go poster.Run()
-	} else {
-		for _, client := range influxClients {
-			name := client.Host
-			destination := newDestination(name, pointChannelCapacity)
-			hashRing.Add(destination)
-			destinations = append(destinations, destination)
-			for p := 0; p < postersPerHost; p++ {
-				poster := newPoster(client, name, destination, posterGroup)
-				posterGroup.Add(1)
-				go func() {
-					poster.Run()
-					posterGroup.Done()
-				}()
-			}
-		}
+func createMessageRoutes(hostlist string, f clientFunc) *routes {
+	routes := newRoutes(f)
+	routes.blackhole = true
+	for _, client := range createClients(hostlist, f) {
+		routes.routes[client.Host] = routes.newRoute(client)
 	}
+	routes.swapRing()
+	return routes
+}
 
-	return hashRing, destinations, posterGroup
+func newInfluxClient(clientConfig influx.ClientConfig) *influx.Client {
+	influxClient, err := influx.NewClient(&clientConfig)
+	if err != nil {
+		panic(err)
+	}
+	return influxClient
 }
 
-func awaitSignals(ss ...io.Closer) {
-	sigCh := make(chan os.Signal)
-	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
-	sig := <-sigCh
-	log.Printf("Got signal: %q", sig)
-	for _, s := range ss {
-		s.Close()
+// Creates the function spools use to replay batches to InfluxDB
+func newSpoolWriter(influxClient *influx.Client) func([]*influx.Series) error {
+	return func(series []*influx.Series) error {
+		return influxClient.WriteSeriesWithTimePrecision(series, influx.Microsecond)
 	}
 }
 
-func awaitShutdown(shutdownChan shutdownChan, server *server, posterGroup *sync.WaitGroup) {
-	<-shutdownChan
-	log.Printf("waiting for inflight requests to finish.")
-	server.Wait()
-	posterGroup.Wait()
-	log.Printf("Shutdown complete.")
+func awaitSignal() os.Signal {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	return <-sigCh
 }
 
 func newClientFunc() *http.Client {
@@ -128,41 +93,82 @@ func newClientFunc() *http.Client {
 	}
 }
 
+// Runs a lumbermill subcommand and exits, if one was given.
+func maybeRunCommand(args []string) {
+	if len(args) == 0 {
+		return
+	}
+
+	var err error
+	switch args[0] {
+	case "sketch":
+		err = sketchCommand(args[1:], os.Stdin, os.Stdout)
+	case "ring":
+		err = ringCommand(args[1:], os.Stdin, os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func main() {
-	hashRing, destinations, posterGroup := createMessageRoutes(os.Getenv("INFLUXDB_HOSTS"), newClientFunc)
-
-	if os.Getenv("LIBRATO_TOKEN") != "" {
-		go librato.Librato(
-			metrics.DefaultRegistry,
-			20*time.Second,
-			os.Getenv("LIBRATO_OWNER"),
-			os.Getenv("LIBRATO_TOKEN"),
-			os.Getenv("LIBRATO_SOURCE"),
-			[]float64{0.50, 0.95, 0.99},
-			time.Millisecond,
-		)
-	} else if os.Getenv("DEBUG") == "true" {
-		go metrics.Log(metrics.DefaultRegistry, 20e9, log.New(os.Stderr, "metrics: ", log.Lmicroseconds))
+	maybeRunCommand(os.Args[1:])
+
+	hosts, err := hostsFromEnv()
+	if err != nil {
+		logger.Fatal("startup", "msg", "unable to read hosts from INFLUXDB_HOSTS_FILE", "file", os.Getenv("INFLUXDB_HOSTS_FILE"), "err", err)
 	}
+	routes := createMessageRoutes(strings.Join(hosts, ","), newClientFunc)
+
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go routes.reloadOn(reloadSignals)
+	go routes.SampleLoad(10 * time.Second)
+
+	reporterConfig := newReporterConfigFromEnv()
+	go runReporters(newReportersFromEnv(reporterConfig), metrics.DefaultRegistry, reporterConfig.interval, nil)
+	go tracing.Run()
 
 	basicAuther, err := auth.NewBasicAuthFromString(os.Getenv("CRED_STORE"))
 	if err != nil {
-		log.Fatalf("Unable to parse credentials from CRED_STORE=%q: err=%q", os.Getenv("CRED_STORE"), err)
+		logger.Fatal("startup", "msg", "unable to parse credentials from CRED_STORE", "err", err)
+	}
+
+	alerter, err := newAlerterFromEnv()
+	if err != nil {
+		logger.Fatal("startup", "msg", "unable to load alert rules from ALERT_RULES_FILE", "file", os.Getenv("ALERT_RULES_FILE"), "err", err)
 	}
 
-	shutdownChan := make(shutdownChan)
-	server := newServer(&http.Server{Addr: ":" + os.Getenv("PORT")}, basicAuther, hashRing)
+	// Drain credentials are handed out with every drain URL, so they don't
+	// grant admin access. Without ADMIN_CRED_STORE nothing does.
+	adminAuther := auth.NewBasicAuth()
+	if creds := os.Getenv("ADMIN_CRED_STORE"); creds != "" {
+		adminAuther, err = auth.NewBasicAuthFromString(creds)
+		if err != nil {
+			logger.Fatal("startup", "msg", "unable to parse credentials from ADMIN_CRED_STORE", "err", err)
+		}
+	} else {
+		logger.Warn("startup", "msg", "ADMIN_CRED_STORE is unset, admin, tap and metrics endpoints are disabled")
+	}
 
-	log.Printf("Starting up")
-	go server.Run(5 * time.Minute)
+	server := newServer(&http.Server{Addr: ":" + os.Getenv("PORT")}, basicAuther, adminAuther, routes)
 
-	var closers []io.Closer
-	closers = append(closers, server)
-	closers = append(closers, shutdownChan)
-	for _, cls := range destinations {
-		closers = append(closers, cls)
+	if alerter != nil {
+		server.alerter = alerter
+		go alerter.Run()
 	}
 
-	go awaitSignals(closers...)
-	awaitShutdown(shutdownChan, server, posterGroup)
+	logger.Info("startup")
+	go server.Run(5 * time.Minute)
+
+	lifecycle := newLifecycleFromEnv(server, routes)
+	logger.Info("shutdown", "signal", awaitSignal())
+	lifecycle.Shutdown()
+	logger.Info("shutdown", "msg", "shutdown complete")
 }
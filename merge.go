@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxSketchMergeBytes = 8 << 20
+
+var defaultMergeQuantiles = []float64{0.50, 0.95, 0.99}
+
+func validateQuantiles(quantiles []float64) error {
+	for _, q := range quantiles {
+		if !(q >= 0 && q <= 1) {
+			return fmt.Errorf("quantile %g is not between 0 and 1", q)
+		}
+	}
+	return nil
+}
+
+type sketchMergeRequest struct {
+	Sketches  []string  `json:"sketches"`
+	Quantiles []float64 `json:"quantiles"`
+}
+
+type sketchMergeResponse struct {
+	Count     uint64             `json:"count"`
+	Quantiles map[string]float64 `json:"quantiles"`
+	Sketch    string             `json:"sketch"`
+}
+
+func newSketchMergeResponse(s *sketch, quantiles []float64) sketchMergeResponse {
+	resp := sketchMergeResponse{
+		Count:     s.Count(),
+		Quantiles: make(map[string]float64),
+		Sketch:    s.String(),
+	}
+	if s.Count() > 0 {
+		for _, q := range quantiles {
+			resp.Quantiles[strconv.FormatFloat(q, 'g', -1, 64)] = s.Quantile(q)
+		}
+	}
+	return resp
+}
+
+// POST /sketch/merge
+//
+// Merges the sketches from router.sketch series, e.g. from several
+// lumbermills or several intervals, and returns the requested quantiles along
+// with the merged sketch. Bodies over maxSketchMergeBytes are rejected.
+func (s *server) serveSketchMerge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		wrongMethodErrorCounter.Inc(1)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSketchMergeBytes))
+	if err != nil {
+		status := http.StatusBadRequest
+		if len(body) >= maxSketchMergeBytes {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		badRequestCounter.Inc(1)
+		return
+	}
+
+	var req sketchMergeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		badRequestCounter.Inc(1)
+		return
+	}
+
+	if err := validateQuantiles(req.Quantiles); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		badRequestCounter.Inc(1)
+		return
+	}
+
+	merged, err := mergeSketches(req.Sketches)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		badRequestCounter.Inc(1)
+		return
+	}
+
+	if len(req.Quantiles) == 0 {
+		req.Quantiles = defaultMergeQuantiles
+	}
+
+	response, err := json.Marshal(newSketchMergeResponse(merged, req.Quantiles))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		internalServerErrorCounter.Inc(1)
+		return
+	}
+
+	headers := w.Header()
+	headers.Set("Content-Length", fmt.Sprintf("%d", len(response)))
+	headers.Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// lumbermill sketch merge [-q 0.5,0.95,0.99] [sketch...]
+//
+// Merges sketches given as arguments, or one per line on stdin, and prints
+// the result as JSON.
+func sketchCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "merge" {
+		return fmt.Errorf("usage: lumbermill sketch merge [-q quantiles] [sketch...]")
+	}
+
+	flags := flag.NewFlagSet("sketch merge", flag.ContinueOnError)
+	qs := flags.String("q", "0.5,0.95,0.99", "comma separated quantiles to report")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var quantiles []float64
+	for _, q := range strings.Split(*qs, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(q), 64)
+		if err != nil {
+			return fmt.Errorf("invalid quantile %q: %s", q, err)
+		}
+		quantiles = append(quantiles, f)
+	}
+	if err := validateQuantiles(quantiles); err != nil {
+		return err
+	}
+
+	encoded := flags.Args()
+	if len(encoded) == 0 {
+		scanner := bufio.NewScanner(stdin)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				encoded = append(encoded, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	merged, err := mergeSketches(encoded)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(stdout)
+	return enc.Encode(newSketchMergeResponse(merged, quantiles))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const otlpTimeout = 10 * time.Second
+
+// Sends OTLP/HTTP JSON requests to a collector, configured with the standard
+// OpenTelemetry environment variables.
+type otlpExporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// Configures an exporter for signal ("metrics" or "traces") from
+// OTEL_EXPORTER_OTLP_<SIGNAL>_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT plus
+// /v1/<signal>, and OTEL_EXPORTER_OTLP_HEADERS ("key1=value1,key2=value2").
+// Returns nil if no endpoint is set.
+func newOTLPExporterFromEnv(signal string) *otlpExporter {
+	url := os.Getenv("OTEL_EXPORTER_OTLP_" + strings.ToUpper(signal) + "_ENDPOINT")
+	if url == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		url = strings.TrimSuffix(base, "/") + "/v1/" + signal
+	}
+
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 {
+			headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return &otlpExporter{url: url, headers: headers, client: &http.Client{Timeout: otlpTimeout}}
+}
+
+func (e *otlpExporter) post(body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %d", e.url, resp.StatusCode)
+	}
+	return nil
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64s are strings in OTLP JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+// An attribute of whatever type value is, formatting anything but strings,
+// numbers and bools as a string.
+func otlpAttributeOf(key string, value interface{}) otlpAttribute {
+	switch v := value.(type) {
+	case string:
+		return otlpString(key, v)
+	case int:
+		return otlpInt(key, int64(v))
+	case int64:
+		return otlpInt(key, v)
+	case float64:
+		return otlpAttribute{Key: key, Value: otlpValue{DoubleValue: &v}}
+	case bool:
+		return otlpAttribute{Key: key, Value: otlpValue{BoolValue: &v}}
+	case error:
+		return otlpString(key, v.Error())
+	case []byte:
+		return otlpString(key, string(v))
+	case fmt.Stringer:
+		return otlpString(key, v.String())
+	default:
+		return otlpString(key, fmt.Sprint(v))
+	}
+}
+
+func otlpInt(key string, value int64) otlpAttribute {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+// The resource metrics and spans are reported with: lumbermill, plus the
+// common tags, in a stable order.
+func otlpResourceFor(tags map[string]string) otlpResource {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	resource := otlpResource{Attributes: []otlpAttribute{otlpString("service.name", "lumbermill")}}
+	for _, k := range keys {
+		resource.Attributes = append(resource.Attributes, otlpString(k, tags[k]))
+	}
+	return resource
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -9,21 +9,42 @@ const (
 	dynoMem
 	dynoLoad
 	dynoEvents
+	routerRollup
+	routerEventRollup
+	routerSketch
+	sloSeries
+	sloBurnSeries
 	numSeries
 )
 
 var (
 	seriesColumns = [][]string{
-		[]string{"time", "status", "service"}, // Router
-		[]string{"time", "code"},              // EventsRouter
-		[]string{"time", "source", "memory_cache", "memory_pgpgin", "memory_pgpgout", "memory_rss", "memory_swap", "memory_total", "dynoType"}, // DynoMem
-		[]string{"time", "source", "load_avg_1m", "load_avg_5m", "load_avg_15m", "dynoType"},                                                   // DynoLoad
-		[]string{"time", "what", "type", "code", "message", "dynoType"},                                                                        // DynoEvents
+		[]string{"time", "status", "service", "connect", "sample_rate"}, // Router
+		[]string{"time", "code"}, // EventsRouter
+		[]string{"time", "source", "memory_cache", "memory_pgpgin", "memory_pgpgout", "memory_rss", "memory_swap", "memory_total", "dynoType", "memory_pct_of_quota", "r14_eta", "r15_eta"}, // DynoMem
+		[]string{"time", "source", "load_avg_1m", "load_avg_5m", "load_avg_15m", "dynoType"},                                                                                                // DynoLoad
+		[]string{"time", "what", "type", "code", "message", "dynoType"},                                                                                                                     // DynoEvents
+		[]string{"time", "count", "status_1xx", "status_2xx", "status_3xx", "status_4xx", "status_5xx",
+			"service_min", "service_max", "service_mean", "service_p50", "service_p95", "service_p99"}, // RouterRollup
+		[]string{"time", "code", "count"},                                          // EventsRouterRollup
+		[]string{"time", "count", "service_sketch", "connect_sketch"},              // RouterSketch
+		[]string{"time", "requests", "errors", "apdex_t", "apdex", "availability"}, // SLO
+		[]string{"time", "window", "error_rate", "burn_rate"},                      // SLOBurn
 	}
 
-	seriesNames = []string{"router", "events.router", "dyno.mem", "dyno.load", "events.dyno"}
+	seriesNames = []string{"router", "events.router", "dyno.mem", "dyno.load", "events.dyno", "router.rollup", "events.router.rollup", "router.sketch", "slo", "slo.burn"}
 )
 
+// Looks up a series type by its name
+func seriesTypeByName(name string) (seriesType, bool) {
+	for i, n := range seriesNames {
+		if n == name {
+			return seriesType(i), true
+		}
+	}
+	return numSeries, false
+}
+
 func (st seriesType) Name() string {
 	return seriesNames[st]
 }
@@ -32,13 +53,28 @@ func (st seriesType) Columns() []string {
 	return seriesColumns[st]
 }
 
+// Whether the series is computed by destinations' aggregators, rather than
+// parsed from drained lines.
+func (st seriesType) Derived() bool {
+	switch st {
+	case routerRollup, routerEventRollup, routerSketch, sloSeries, sloBurnSeries:
+		return true
+	}
+	return false
+}
+
 // Holds data around a data point
 type point struct {
 	Token  string
 	Type   seriesType
 	Points []interface{}
+	Skewed bool         // Timestamp was outside of the skew policy's window
+	Trace  *spanContext // The sampled drain request the point was parsed from, or nil
 }
 
 func (p point) SeriesName() string {
+	if p.Skewed {
+		return "skewed." + p.Type.Name() + "." + p.Token
+	}
 	return p.Type.Name() + "." + p.Token
 }
@@ -1,24 +1,35 @@
 package main
 
 import (
-	"log"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	influx "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/influxdb/influxdb-go"
 	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
 )
 
+const (
+	defaultPosterRetryMaxAge = 30 * time.Second
+	posterRetryBaseBackoff   = 100 * time.Millisecond
+	posterRetryMaxBackoff    = 10 * time.Second
+)
+
 var deliverySizeHistogram = metrics.GetOrRegisterHistogram("lumbermill.poster.deliver.sizes", metrics.DefaultRegistry, metrics.NewUniformSample(100))
 
 type poster struct {
 	destination          *destination
 	name                 string
 	influxClient         *influx.Client
+	retryMaxAge          time.Duration
 	pointsSuccessCounter metrics.Counter
 	pointsSuccessTime    metrics.Timer
-	pointsFailureCounter metrics.Counter
 	pointsFailureTime    metrics.Timer
+	errorCounters        []metrics.Counter // By writeErrorClass
+	retryCounter         metrics.Counter
+	splitCounter         metrics.Counter
+	stop                 chan struct{} // Closed to stop this poster while its destination stays open
 }
 
 func newPoster(clientConfig influx.ClientConfig, name string, destination *destination, waitGroup *sync.WaitGroup) *poster {
@@ -28,14 +39,22 @@ func newPoster(clientConfig influx.ClientConfig, name string, destination *desti
 		panic(err)
 	}
 
+	errorCounters := make([]metrics.Counter, numWriteErrorClasses)
+	for c := writeErrorClass(0); c < numWriteErrorClasses; c++ {
+		errorCounters[c] = metrics.GetOrRegisterCounter("lumbermill.poster.error."+c.Name()+"."+name, metrics.DefaultRegistry)
+	}
+
 	return &poster{
 		destination:          destination,
 		name:                 name,
 		influxClient:         influxClient,
+		retryMaxAge:          envDuration("POSTER_RETRY_MAX_AGE", defaultPosterRetryMaxAge),
 		pointsSuccessCounter: metrics.GetOrRegisterCounter("lumbermill.poster.deliver.points."+name, metrics.DefaultRegistry),
 		pointsSuccessTime:    metrics.GetOrRegisterTimer("lumbermill.poster.success.time."+name, metrics.DefaultRegistry),
-		pointsFailureCounter: metrics.GetOrRegisterCounter("lumbermill.poster.error.points."+name, metrics.DefaultRegistry),
 		pointsFailureTime:    metrics.GetOrRegisterTimer("lumbermill.poster.error.time."+name, metrics.DefaultRegistry),
+		errorCounters:        errorCounters,
+		retryCounter:         metrics.GetOrRegisterCounter("lumbermill.poster.retries."+name, metrics.DefaultRegistry),
+		splitCounter:         metrics.GetOrRegisterCounter("lumbermill.poster.splits."+name, metrics.DefaultRegistry),
 	}
 }
 
@@ -49,39 +68,81 @@ func makeSeries(p point) *influx.Series {
 func (p *poster) Run() {
 	var last bool
 	var delivery map[string]*influx.Series
+	var links spanLinks
 
 	timeout := time.NewTicker(time.Second)
 	defer func() { timeout.Stop() }()
 
 	for !last {
-		delivery, last = p.nextDelivery(timeout)
-		p.deliver(delivery)
+		p.destination.waitWhilePaused(p.stop)
+
+		var taken int64
+		links = spanLinks{}
+		delivery, taken, last = p.nextDelivery(timeout, &links)
+		if last && !p.stopped() {
+			addToDelivery(delivery, p.destination.aggregator.Flush()...)
+		}
+		p.deliver(delivery, links.contexts)
+		atomic.AddInt64(&p.destination.inFlight, -taken)
+	}
+}
+
+func addToDelivery(delivery map[string]*influx.Series, points ...point) {
+	for _, point := range points {
+		seriesName := point.SeriesName()
+		series, found := delivery[seriesName]
+		if !found {
+			series = makeSeries(point)
+		}
+		series.Points = append(series.Points, point.Points)
+		delivery[seriesName] = series
 	}
 }
 
-func (p *poster) nextDelivery(timeout *time.Ticker) (delivery map[string]*influx.Series, last bool) {
+// Whether the poster was stopped, rather than its destination closed.
+func (p *poster) stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Collects points, and links to the sampled requests they came from, until
+// the next tick or flush, or until the destination is closed or the poster
+// stopped. Returns how many were taken off the destination's queue and not
+// rolled up.
+func (p *poster) nextDelivery(timeout *time.Ticker, links *spanLinks) (delivery map[string]*influx.Series, taken int64, last bool) {
 	delivery = make(map[string]*influx.Series)
+	flush := p.destination.flushed()
 	for {
 		select {
+		case <-p.stop:
+			return delivery, taken, true
+		case <-flush:
+			addToDelivery(delivery, p.destination.aggregator.Finished(time.Now())...)
+			return delivery, taken, false
 		case point, open := <-p.destination.points:
 			if open {
-				seriesName := point.SeriesName()
-				series, found := delivery[seriesName]
-				if !found {
-					series = makeSeries(point)
+				if p.destination.aggregator.Add(point) {
+					continue
 				}
-				series.Points = append(series.Points, point.Points)
-				delivery[seriesName] = series
+				addToDelivery(delivery, point)
+				links.add(point.Trace)
+				taken++
+				atomic.AddInt64(&p.destination.inFlight, 1)
 			} else {
-				return delivery, true
+				return delivery, taken, true
 			}
-		case <-timeout.C:
-			return delivery, false
+		case now := <-timeout.C:
+			addToDelivery(delivery, p.destination.aggregator.Due(now)...)
+			return delivery, taken, false
 		}
 	}
 }
 
-func (p *poster) deliver(allSeries map[string]*influx.Series) {
+func (p *poster) deliver(allSeries map[string]*influx.Series, links []spanContext) {
 	pointCount := 0
 	seriesGroup := make([]*influx.Series, 0, len(allSeries))
 
@@ -94,18 +155,75 @@ func (p *poster) deliver(allSeries map[string]*influx.Series) {
 		return
 	}
 
-	start := time.Now()
-	err := p.influxClient.WriteSeriesWithTimePrecision(seriesGroup, influx.Microsecond)
+	span := tracing.StartLinked("influxdb.write", links)
+	defer span.End()
+	span.SetAttributes("lumbermill.destination", p.name, "lumbermill.points", pointCount, "lumbermill.series", len(seriesGroup))
 
-	if err != nil {
-		// TODO: Ugh. These could be timeout errors, or an internal error.
-		//       Should probably attempt to figure out which...
-		p.pointsFailureCounter.Inc(1)
+	p.write(seriesGroup, time.Now().Add(p.retryMaxAge), span)
+}
+
+// Writes the batch, retrying retryable errors with jittered exponential
+// backoff until the deadline, and splitting batches that are too large.
+// Batches that still can't be written are spooled, unless the error was
+// permanent. Attempts are recorded on span.
+func (p *poster) write(series []*influx.Series, deadline time.Time, span *span) {
+	backoff := posterRetryBaseBackoff
+
+	for {
+		start := time.Now()
+		err := p.influxClient.WriteSeriesWithTimePrecision(series, influx.Microsecond)
+		p.destination.recordWrite(err)
+		if err == nil {
+			p.destination.breaker.Success()
+			p.pointsSuccessCounter.Inc(1)
+			p.pointsSuccessTime.UpdateSince(start)
+			deliverySizeHistogram.Update(int64(countPoints(series)))
+			return
+		}
+
+		class := classifyWriteError(err)
+		p.errorCounters[class].Inc(1)
 		p.pointsFailureTime.UpdateSince(start)
-		log.Printf("Error posting points: %s\n", err)
-	} else {
-		p.pointsSuccessCounter.Inc(1)
-		p.pointsSuccessTime.UpdateSince(start)
-		deliverySizeHistogram.Update(int64(pointCount))
+		span.AddEvent("write-error", "class", class.Name(), "points", countPoints(series), "err", err)
+
+		switch class {
+		case writeTooLarge:
+			if a, b, ok := splitSeries(series); ok {
+				p.splitCounter.Inc(1)
+				span.AddEvent("split")
+				p.write(a, deadline, span)
+				p.write(b, deadline, span)
+				return
+			}
+			logger.Error("poster", "destination", p.name, "class", class.Name(), "points", countPoints(series), "err", err)
+			span.SetError(err)
+			return
+
+		case writePermanent:
+			logger.Error("poster", "destination", p.name, "class", class.Name(), "points", countPoints(series), "err", err)
+			span.SetError(err)
+			return
+		}
+
+		p.destination.breaker.Failure()
+
+		// Sleep for between half and all of the backoff.
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if time.Now().Add(sleep).After(deadline) {
+			logger.Error("poster", "destination", p.name, "class", class.Name(), "points", countPoints(series), "err", err, "msg", "giving up")
+			span.SetError(err)
+			if err := p.destination.spool.Append(series); err != nil {
+				logger.Error("spool", "destination", p.name, "err", err)
+			} else if p.destination.spool != nil {
+				span.AddEvent("spooled", "points", countPoints(series))
+			}
+			return
+		}
+
+		p.retryCounter.Inc(1)
+		time.Sleep(sleep)
+		if backoff *= 2; backoff > posterRetryMaxBackoff {
+			backoff = posterRetryMaxBackoff
+		}
 	}
 }
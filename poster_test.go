@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	influx "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/influxdb/influxdb-go"
+)
+
+func TestClassifyWriteError(t *testing.T) {
+	cases := map[error]writeErrorClass{
+		errors.New("Server returned (500): oops"):          writeRetryable,
+		errors.New("Server returned (503): unavailable"):   writeRetryable,
+		errors.New("Server returned (429): slow down"):     writeRetryable,
+		errors.New("Server returned (400): bad column"):    writePermanent,
+		errors.New("Server returned (401): unauthorized"):  writePermanent,
+		errors.New("Server returned (413): too large"):     writeTooLarge,
+		&url.Error{Op: "Post", Err: errors.New("timeout")}: writeRetryable,
+		errors.New("json: unsupported value"):              writePermanent,
+	}
+
+	for err, expected := range cases {
+		if class := classifyWriteError(err); class != expected {
+			t.Errorf("%q: expected %s, got %s", err, expected.Name(), class.Name())
+		}
+	}
+}
+
+// Serves the statuses in turn, then 200s, recording the number of points in
+// each request.
+func newStatusSequenceHandler(statuses ...int) (http.HandlerFunc, *[]int) {
+	var lock sync.Mutex
+	var sizes []int
+	return func(w http.ResponseWriter, r *http.Request) {
+		var series []*influx.Series
+		json.NewDecoder(r.Body).Decode(&series)
+
+		lock.Lock()
+		defer lock.Unlock()
+		sizes = append(sizes, countPoints(series))
+
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}, &sizes
+}
+
+func newTestPoster(t *testing.T, handler http.HandlerFunc) (*poster, func()) {
+	influxdb := setupInfluxDBTestServer(handler)
+	host := extractHostPort(influxdb.URL)
+	p := newPoster(createInfluxDBClient(host, newTestClientFunc), host, newDestination(host, 1), new(sync.WaitGroup))
+	return p, influxdb.Close
+}
+
+func testSeries(points int) []*influx.Series {
+	s := &influx.Series{Name: "router.foo", Columns: seriesColumns[routerRequest]}
+	for i := 0; i < points; i++ {
+		s.Points = append(s.Points, []interface{}{int64(i), 200, 10, 1})
+	}
+	return []*influx.Series{s}
+}
+
+func TestPosterRetriesRetryableErrors(t *testing.T) {
+	handler, sizes := newStatusSequenceHandler(503, 429)
+	p, cleanup := newTestPoster(t, handler)
+	defer cleanup()
+
+	retries := p.retryCounter.Count()
+	p.write(testSeries(4), time.Now().Add(time.Minute), nil)
+
+	if len(*sizes) != 3 {
+		t.Errorf("Expected 3 attempts, got %d", len(*sizes))
+	}
+	if p.retryCounter.Count()-retries != 2 {
+		t.Errorf("Expected 2 retries, got %d", p.retryCounter.Count()-retries)
+	}
+}
+
+func TestPosterDoesNotRetryPermanentErrors(t *testing.T) {
+	handler, sizes := newStatusSequenceHandler(400, 400)
+	p, cleanup := newTestPoster(t, handler)
+	defer cleanup()
+
+	permanent := p.errorCounters[writePermanent].Count()
+	p.write(testSeries(4), time.Now().Add(time.Minute), nil)
+
+	if len(*sizes) != 1 {
+		t.Errorf("Expected 1 attempt, got %d", len(*sizes))
+	}
+	if p.errorCounters[writePermanent].Count()-permanent != 1 {
+		t.Errorf("Expected a permanent error to be counted")
+	}
+}
+
+func TestPosterGivesUpAtDeadline(t *testing.T) {
+	handler, sizes := newStatusSequenceHandler(503, 503, 503, 503, 503, 503, 503, 503)
+	p, cleanup := newTestPoster(t, handler)
+	defer cleanup()
+
+	p.write(testSeries(4), time.Now().Add(250*time.Millisecond), nil)
+
+	if len(*sizes) < 2 || len(*sizes) > 4 {
+		t.Errorf("Expected a few attempts before the deadline, got %d", len(*sizes))
+	}
+}
+
+func TestPosterSplitsTooLargeBatches(t *testing.T) {
+	handler, sizes := newStatusSequenceHandler(413, 413)
+	p, cleanup := newTestPoster(t, handler)
+	defer cleanup()
+
+	p.write(testSeries(8), time.Now().Add(time.Minute), nil)
+
+	// 8 is too large, the first 4 is too large, then 2, 2 and 4 succeed.
+	expected := []int{8, 4, 2, 2, 4}
+	if len(*sizes) != len(expected) {
+		t.Fatalf("Expected requests of %v points, got %v", expected, *sizes)
+	}
+	for i := range expected {
+		if (*sizes)[i] != expected[i] {
+			t.Errorf("Expected requests of %v points, got %v", expected, *sizes)
+			break
+		}
+	}
+}
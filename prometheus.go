@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+var (
+	prometheusQuantiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+	prometheusInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	// Metrics registered per host or code, whose suffixes become
+	// labels. More specific prefixes come first.
+	prometheusLabelledPrefixes = []struct {
+		prefix string
+		labels []string
+	}{
+		{"lumbermill.poster.deliver.points.", []string{"host"}},
+		{"lumbermill.poster.success.time.", []string{"host"}},
+		{"lumbermill.poster.error.time.", []string{"host"}},
+		{"lumbermill.poster.error.", []string{"class", "host"}},
+		{"lumbermill.poster.retries.", []string{"host"}},
+		{"lumbermill.poster.splits.", []string{"host"}},
+		{"lumbermill.breaker.opened.", []string{"host"}},
+		{"lumbermill.breaker.closed.", []string{"host"}},
+		{"lumbermill.breaker.open.", []string{"host"}},
+		{"lumbermill.spool.depth.bytes.", []string{"host"}},
+		{"lumbermill.spool.depth.segments.", []string{"host"}},
+		{"lumbermill.spool.appended.points.", []string{"host"}},
+		{"lumbermill.spool.dropped.points.", []string{"host"}},
+		{"lumbermill.spool.corrupt.", []string{"host"}},
+		{"lumbermill.spool.rejected.points.", []string{"host"}},
+		{"lumbermill.spool.replayed.points.", []string{"host"}},
+		{"lumbermill.ring.load.pct_of_avg.", []string{"host"}},
+		{"lumbermill.points.pending.", []string{"host"}},
+		{"lumbermill.lines.router.errors.", []string{"code"}},
+	}
+)
+
+type prometheusLabel struct {
+	name, value string
+}
+
+type prometheusSample struct {
+	suffix string // e.g. _sum
+	labels []prometheusLabel
+	value  string
+}
+
+// All the samples of one metric name, which share a type, grouped by the
+// go-metrics metric they came from.
+type prometheusFamily struct {
+	kind   string
+	groups [][]prometheusSample
+}
+
+// Splits a go-metrics name into a Prometheus metric name and labels, e.g.
+// lumbermill.poster.error.retryable.influx1:8086 into lumbermill_poster_error
+// with class="retryable" and host="influx1:8086".
+func prometheusName(name string) (string, []prometheusLabel) {
+	var labels []prometheusLabel
+	for _, lp := range prometheusLabelledPrefixes {
+		if !strings.HasPrefix(name, lp.prefix) || len(name) == len(lp.prefix) {
+			continue
+		}
+
+		// The last label takes the rest of the name, as hosts contain dots.
+		values := strings.SplitN(name[len(lp.prefix):], ".", len(lp.labels))
+		if len(values) != len(lp.labels) {
+			continue
+		}
+		for i, label := range lp.labels {
+			labels = append(labels, prometheusLabel{label, values[i]})
+		}
+		name = strings.TrimSuffix(lp.prefix, ".")
+		break
+	}
+	return prometheusInvalidChars.ReplaceAllString(name, "_"), labels
+}
+
+func formatPrometheusFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Summary samples for a histogram or timer, scaled by unit.
+func prometheusSummary(labels []prometheusLabel, count int64, mean float64, percentiles []float64, unit float64) []prometheusSample {
+	samples := make([]prometheusSample, 0, len(percentiles)+2)
+	for i, q := range prometheusQuantiles {
+		quantile := append(append([]prometheusLabel(nil), labels...), prometheusLabel{"quantile", formatPrometheusFloat(q)})
+		samples = append(samples, prometheusSample{labels: quantile, value: formatPrometheusFloat(percentiles[i] * unit)})
+	}
+	// go-metrics doesn't keep a sum, so it's estimated from the sample's mean.
+	return append(samples,
+		prometheusSample{suffix: "_sum", labels: labels, value: formatPrometheusFloat(mean * float64(count) * unit)},
+		prometheusSample{suffix: "_count", labels: labels, value: strconv.FormatInt(count, 10)},
+	)
+}
+
+// Renders the registry in the Prometheus text exposition format. Counters and
+// meters become counters, gauges gauges, and histograms and timers (in
+// seconds) summaries.
+func writePrometheus(w io.Writer, r metrics.Registry) {
+	families := make(map[string]*prometheusFamily)
+	add := func(name, kind string, samples ...prometheusSample) {
+		f, ok := families[name]
+		if !ok {
+			f = &prometheusFamily{kind: kind}
+			families[name] = f
+		} else if f.kind != kind {
+			return // Prometheus requires every sample of a metric to be the same type
+		}
+		f.groups = append(f.groups, samples)
+	}
+
+	r.Each(func(metricName string, i interface{}) {
+		name, labels := prometheusName(metricName)
+		switch m := i.(type) {
+		case metrics.Counter:
+			add(name+"_total", "counter", prometheusSample{labels: labels, value: strconv.FormatInt(m.Count(), 10)})
+		case metrics.Meter:
+			add(name+"_total", "counter", prometheusSample{labels: labels, value: strconv.FormatInt(m.Snapshot().Count(), 10)})
+		case metrics.Gauge:
+			add(name, "gauge", prometheusSample{labels: labels, value: strconv.FormatInt(m.Value(), 10)})
+		case metrics.GaugeFloat64:
+			add(name, "gauge", prometheusSample{labels: labels, value: formatPrometheusFloat(m.Value())})
+		case metrics.Histogram:
+			h := m.Snapshot()
+			add(name, "summary", prometheusSummary(labels, h.Count(), h.Mean(), h.Percentiles(prometheusQuantiles), 1)...)
+		case metrics.Timer:
+			t := m.Snapshot()
+			add(name+"_seconds", "summary", prometheusSummary(labels, t.Count(), t.Mean(), t.Percentiles(prometheusQuantiles), 1/float64(time.Second))...)
+		}
+	})
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+		// Sorted by labels, keeping each summary's samples together.
+		sort.Slice(f.groups, func(i, j int) bool {
+			a, b := f.groups[i], f.groups[j]
+			return formatPrometheusLabels(a[len(a)-1].labels) < formatPrometheusLabels(b[len(b)-1].labels)
+		})
+		for _, group := range f.groups {
+			for _, s := range group {
+				fmt.Fprintf(w, "%s%s%s %s\n", name, s.suffix, formatPrometheusLabels(s.labels), s.value)
+			}
+		}
+	}
+}
+
+func formatPrometheusLabels(labels []prometheusLabel) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.name)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(l.value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// GET /metrics
+func (s *server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		wrongMethodErrorCounter.Inc(1)
+		return
+	}
+
+	var b bytes.Buffer
+	writePrometheus(&b, metrics.DefaultRegistry)
+
+	headers := w.Header()
+	headers.Set("Content-Length", fmt.Sprintf("%d", b.Len()))
+	headers.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+func TestPrometheusName(t *testing.T) {
+	tests := []struct {
+		in, name, labels string
+	}{
+		{"lumbermill.batch", "lumbermill_batch", ""},
+		{"lumbermill.poster.success.time.influx1.example.com:8086", "lumbermill_poster_success_time", `{host="influx1.example.com:8086"}`},
+		{"lumbermill.poster.error.retryable.influx1.example.com:8086", "lumbermill_poster_error", `{class="retryable",host="influx1.example.com:8086"}`},
+		{"lumbermill.poster.error.time.influx1:8086", "lumbermill_poster_error_time", `{host="influx1:8086"}`},
+		{"lumbermill.ring.load.max_pct_of_avg", "lumbermill_ring_load_max_pct_of_avg", ""},
+		{"lumbermill.lines.router.errors.H12", "lumbermill_lines_router_errors", `{code="H12"}`},
+	}
+
+	for _, test := range tests {
+		name, labels := prometheusName(test.in)
+		if name != test.name || formatPrometheusLabels(labels) != test.labels {
+			t.Errorf("%s: expected %s%s, got %s%s", test.in, test.name, test.labels, name, formatPrometheusLabels(labels))
+		}
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("lumbermill.batch", r).Inc(3)
+	metrics.GetOrRegisterCounter("lumbermill.poster.error.permanent.b:8086", r).Inc(1)
+	metrics.GetOrRegisterCounter("lumbermill.poster.error.retryable.a:8086", r).Inc(2)
+	metrics.GetOrRegisterGauge("lumbermill.ring.version", r).Update(4)
+	metrics.GetOrRegisterGauge("lumbermill.points.pending.influx1.example.com:8086", r).Update(3)
+	metrics.GetOrRegisterHistogram("lumbermill.batches.sizes", r, metrics.NewUniformSample(100)).Update(10)
+	metrics.GetOrRegisterTimer("lumbermill.poster.success.time.a:8086", r).Update(2 * time.Second)
+
+	var b bytes.Buffer
+	writePrometheus(&b, r)
+
+	expected := `# TYPE lumbermill_batch_total counter
+lumbermill_batch_total 3
+# TYPE lumbermill_batches_sizes summary
+lumbermill_batches_sizes{quantile="0.5"} 10
+lumbermill_batches_sizes{quantile="0.75"} 10
+lumbermill_batches_sizes{quantile="0.95"} 10
+lumbermill_batches_sizes{quantile="0.99"} 10
+lumbermill_batches_sizes{quantile="0.999"} 10
+lumbermill_batches_sizes_sum 10
+lumbermill_batches_sizes_count 1
+# TYPE lumbermill_points_pending gauge
+lumbermill_points_pending{host="influx1.example.com:8086"} 3
+# TYPE lumbermill_poster_error_total counter
+lumbermill_poster_error_total{class="permanent",host="b:8086"} 1
+lumbermill_poster_error_total{class="retryable",host="a:8086"} 2
+# TYPE lumbermill_poster_success_time_seconds summary
+lumbermill_poster_success_time_seconds{host="a:8086",quantile="0.5"} 2
+lumbermill_poster_success_time_seconds{host="a:8086",quantile="0.75"} 2
+lumbermill_poster_success_time_seconds{host="a:8086",quantile="0.95"} 2
+lumbermill_poster_success_time_seconds{host="a:8086",quantile="0.99"} 2
+lumbermill_poster_success_time_seconds{host="a:8086",quantile="0.999"} 2
+lumbermill_poster_success_time_seconds_sum{host="a:8086"} 2
+lumbermill_poster_success_time_seconds_count{host="a:8086"} 1
+# TYPE lumbermill_ring_version gauge
+lumbermill_ring_version 4
+`
+	if b.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, newRoutes(newTestClientFunc))
+	batchCounter.Inc(1)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	server.http.Handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "# TYPE lumbermill_batch_total counter\n") {
+		t.Errorf("Unexpected response %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+}
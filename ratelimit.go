@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+const (
+	defaultRateLimitBurst = time.Second
+	rateLimitIdleTimeout  = 10 * time.Minute
+)
+
+var (
+	rateLimitedLinesCounter  = metrics.GetOrRegisterCounter("lumbermill.ratelimit.lines.limited", metrics.DefaultRegistry)
+	rateLimitedPointsCounter = metrics.GetOrRegisterCounter("lumbermill.ratelimit.points.limited", metrics.DefaultRegistry)
+)
+
+// Lines and points per second. 0 is unlimited.
+type rateLimits struct {
+	Lines  float64 `json:"lines_per_sec"`
+	Points float64 `json:"points_per_sec"`
+}
+
+// A token bucket, refilled at rate per second up to burst.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst time.Duration, now time.Time) *tokenBucket {
+	b := &tokenBucket{rate: rate, burst: rate * burst.Seconds(), last: now}
+	if b.burst < 1 {
+		b.burst = 1
+	}
+	b.tokens = b.burst
+	return b
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Lines and points over a token's limits
+type rateLimitStats struct {
+	LinesLimited  int64 `json:"lines_limited"`
+	PointsLimited int64 `json:"points_limited"`
+	LinesSampled  int64 `json:"lines_sampled"` // Kept despite being over the limit
+	PointsSampled int64 `json:"points_sampled"`
+}
+
+// Locked on its own, so tokens don't contend with each other
+type tokenRateLimit struct {
+	sync.Mutex
+	limits   rateLimits
+	lines    *tokenBucket // nil when unlimited
+	points   *tokenBucket
+	lastSeen time.Time
+	stats    rateLimitStats
+}
+
+// Per token rate limits on the lines and points accepted by /drain. Lines and
+// points over a token's limit are dropped or, if sampleEvery is above 0, 1 in
+// sampleEvery of them is kept. Only the totals are counted in metrics;
+// per token counts are shown by /admin/ratelimits.
+type rateLimiter struct {
+	sync.RWMutex
+	defaults    rateLimits
+	overrides   map[string]rateLimits
+	burst       time.Duration
+	sampleEvery int64
+	tokens      map[string]*tokenRateLimit // Guarded by the lock, as is lastPrune
+	lastPrune   time.Time
+}
+
+func newRateLimiter(defaults rateLimits, overrides map[string]rateLimits, burst time.Duration, sampleEvery int64) *rateLimiter {
+	return &rateLimiter{
+		defaults:    defaults,
+		overrides:   overrides,
+		burst:       burst,
+		sampleEvery: sampleEvery,
+		tokens:      make(map[string]*tokenRateLimit),
+	}
+}
+
+// Configures the limiter from RATE_LIMIT_LINES, RATE_LIMIT_POINTS,
+// RATE_LIMIT_TOKENS ("token1:lines=100,points=50|token2:lines=1000"),
+// RATE_LIMIT_BURST and RATE_LIMIT_SAMPLE. Returns nil if nothing is limited.
+func newRateLimiterFromEnv() *rateLimiter {
+	defaults := rateLimits{
+		Lines:  envFloat("RATE_LIMIT_LINES", 0),
+		Points: envFloat("RATE_LIMIT_POINTS", 0),
+	}
+
+	overrides := make(map[string]rateLimits)
+	for token, v := range parseKeyValueList(os.Getenv("RATE_LIMIT_TOKENS")) {
+		limits := defaults
+		for _, l := range strings.Split(v, ",") {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 {
+				logger.Warn("ratelimit", "err", "invalid limit", "token", token, "limit", l)
+				continue
+			}
+			rate, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+			if err != nil {
+				logger.Warn("ratelimit", "err", err, "token", token, "limit", l)
+				continue
+			}
+			switch strings.TrimSpace(kv[0]) {
+			case "lines":
+				limits.Lines = rate
+			case "points":
+				limits.Points = rate
+			default:
+				logger.Warn("ratelimit", "err", "unknown limit", "token", token, "limit", l)
+			}
+		}
+		overrides[token] = limits
+	}
+
+	if defaults.Lines <= 0 && defaults.Points <= 0 && len(overrides) == 0 {
+		return nil
+	}
+
+	return newRateLimiter(defaults, overrides,
+		envDuration("RATE_LIMIT_BURST", defaultRateLimitBurst),
+		int64(envInt("RATE_LIMIT_SAMPLE", 0)),
+	)
+}
+
+// Looks up the token's limits, creating them if it hasn't been seen
+// recently, and forgets those of tokens that have been idle.
+func (rl *rateLimiter) limit(token string, now time.Time) *tokenRateLimit {
+	rl.RLock()
+	l, ok := rl.tokens[token]
+	prune := now.Sub(rl.lastPrune) > rateLimitIdleTimeout
+	rl.RUnlock()
+	if ok && !prune {
+		return l
+	}
+
+	rl.Lock()
+	defer rl.Unlock()
+
+	if now.Sub(rl.lastPrune) > rateLimitIdleTimeout {
+		for t, l := range rl.tokens {
+			l.Lock()
+			idle := now.Sub(l.lastSeen) > rateLimitIdleTimeout
+			l.Unlock()
+			if idle && t != token {
+				delete(rl.tokens, t)
+			}
+		}
+		rl.lastPrune = now
+	}
+
+	l, ok = rl.tokens[token]
+	if !ok {
+		limits, ok := rl.overrides[token]
+		if !ok {
+			limits = rl.defaults
+		}
+		l = &tokenRateLimit{limits: limits, lastSeen: now}
+		if limits.Lines > 0 {
+			l.lines = newTokenBucket(limits.Lines, rl.burst, now)
+		}
+		if limits.Points > 0 {
+			l.points = newTokenBucket(limits.Points, rl.burst, now)
+		}
+		rl.tokens[token] = l
+	}
+	return l
+}
+
+// Whether a line or point over the limit should be kept anyway, as a sample.
+func (rl *rateLimiter) sample(limited int64) bool {
+	return rl.sampleEvery > 0 && limited%rl.sampleEvery == 0
+}
+
+// Whether the token's next line should be processed.
+func (rl *rateLimiter) AllowLine(token string) bool {
+	if rl == nil {
+		return true
+	}
+
+	now := time.Now()
+	l := rl.limit(token, now)
+	l.Lock()
+	defer l.Unlock()
+
+	l.lastSeen = now
+	if l.lines.take(now) {
+		return true
+	}
+
+	l.stats.LinesLimited++
+	rateLimitedLinesCounter.Inc(1)
+
+	if rl.sample(l.stats.LinesLimited) {
+		l.stats.LinesSampled++
+		return true
+	}
+	return false
+}
+
+// Whether the token's next point should be posted.
+func (rl *rateLimiter) AllowPoint(token string) bool {
+	if rl == nil {
+		return true
+	}
+
+	now := time.Now()
+	l := rl.limit(token, now)
+	l.Lock()
+	defer l.Unlock()
+
+	l.lastSeen = now
+	if l.points.take(now) {
+		return true
+	}
+
+	l.stats.PointsLimited++
+	rateLimitedPointsCounter.Inc(1)
+
+	if rl.sample(l.stats.PointsLimited) {
+		l.stats.PointsSampled++
+		return true
+	}
+	return false
+}
+
+type tokenRateLimitResponse struct {
+	rateLimits
+	rateLimitStats
+}
+
+type rateLimitsResponse struct {
+	Default     rateLimits                        `json:"default"`
+	Overrides   map[string]rateLimits             `json:"overrides"`
+	SampleEvery int64                             `json:"sample_every"`
+	Tokens      map[string]tokenRateLimitResponse `json:"tokens"`
+}
+
+// GET /admin/ratelimits
+// GET /admin/ratelimits/<token>
+//
+// Shows the configured limits, and how many lines and points of each recently
+// seen token have been limited.
+func (s *server) serveRateLimits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		wrongMethodErrorCounter.Inc(1)
+		return
+	}
+
+	rl := s.rateLimiter
+	if rl == nil {
+		http.Error(w, "rate limiting is disabled", http.StatusNotFound)
+		return
+	}
+	token := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/ratelimits"), "/")
+
+	rl.RLock()
+	resp := rateLimitsResponse{
+		Default:     rl.defaults,
+		Overrides:   rl.overrides,
+		SampleEvery: rl.sampleEvery,
+		Tokens:      make(map[string]tokenRateLimitResponse),
+	}
+	for t, l := range rl.tokens {
+		if token == "" || t == token {
+			l.Lock()
+			resp.Tokens[t] = tokenRateLimitResponse{l.limits, l.stats}
+			l.Unlock()
+		}
+	}
+	rl.RUnlock()
+
+	response, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		internalServerErrorCounter.Inc(1)
+		return
+	}
+
+	headers := w.Header()
+	headers.Set("Content-Length", fmt.Sprintf("%d", len(response)))
+	headers.Set("Content-Type", "application/json")
+	w.Write(response)
+}
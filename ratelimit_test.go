@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, time.Second, now)
+
+	if !b.take(now) || !b.take(now) {
+		t.Fatal("Expected a burst of 2")
+	}
+	if b.take(now) {
+		t.Fatal("Expected the bucket to be empty")
+	}
+	if !b.take(now.Add(500 * time.Millisecond)) {
+		t.Fatal("Expected the bucket to refill at 2/s")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(rateLimits{Lines: 1}, map[string]rateLimits{"t.noisy": {Points: 1}}, time.Second, 0)
+
+	if !rl.AllowLine("t.quiet") || rl.AllowLine("t.quiet") {
+		t.Error("Expected the default limit of 1 line to apply")
+	}
+	if !rl.AllowLine("t.noisy") || !rl.AllowLine("t.noisy") {
+		t.Error("Expected the override not to limit lines")
+	}
+	if !rl.AllowPoint("t.noisy") || rl.AllowPoint("t.noisy") {
+		t.Error("Expected the override to limit points")
+	}
+
+	// Sampling keeps 1 in 2 limited lines.
+	rl = newRateLimiter(rateLimits{Lines: 1}, nil, time.Second, 2)
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if rl.AllowLine("t.quiet") {
+			allowed++
+		}
+	}
+	if allowed != 3 || rl.tokens["t.quiet"].stats.LinesSampled != 2 {
+		t.Errorf("Expected 1 line plus 2 samples, got %d", allowed)
+	}
+	if metrics.DefaultRegistry.Get("lumbermill.ratelimit.lines.limited.t.quiet") != nil {
+		t.Error("Expected limited lines to be counted per token by the limiter alone")
+	}
+}
+
+func TestServeRateLimits(t *testing.T) {
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, newRoutes(newTestClientFunc))
+	server.rateLimiter = newRateLimiter(rateLimits{Lines: 1}, nil, time.Second, 0)
+	server.rateLimiter.AllowLine("t.a")
+	server.rateLimiter.AllowLine("t.a")
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/ratelimits/t.a", nil)
+	server.http.Handler.ServeHTTP(recorder, req)
+
+	expected := `{"default":{"lines_per_sec":1,"points_per_sec":0},"overrides":null,"sample_every":0,"tokens":{"t.a":{"lines_per_sec":1,"points_per_sec":0,"lines_limited":1,"points_limited":0,"lines_sampled":0,"points_sampled":0}}}`
+	if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+		t.Errorf("Unexpected response %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
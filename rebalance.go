@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	influx "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/influxdb/influxdb-go"
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+var (
+	backfillSeriesCounter = metrics.GetOrRegisterCounter("lumbermill.ring.backfill.series", metrics.DefaultRegistry)
+	backfillPointsCounter = metrics.GetOrRegisterCounter("lumbermill.ring.backfill.points", metrics.DefaultRegistry)
+	backfillErrorCounter  = metrics.GetOrRegisterCounter("lumbermill.ring.backfill.errors", metrics.DefaultRegistry)
+)
+
+// The topology before the latest membership change. Until it ends, tokens'
+// history may be on their previous hosts, so /target reports both.
+type ringTransition struct {
+	previous Router
+	ends     time.Time
+}
+
+// The previous topology and when the transition to the current one ends, or
+// nil if there's no transition in progress.
+func (r *routes) Transition() (Router, time.Time) {
+	t, _ := r.transition.Load().(*ringTransition)
+	if t == nil || time.Now().After(t.ends) {
+		return nil, time.Time{}
+	}
+	return t.previous, t.ends
+}
+
+// Whether a transition or backfill is still in progress. Must be called with
+// the lock held.
+func (r *routes) transitioning() bool {
+	if r.backfilling {
+		return true
+	}
+	previous, _ := r.Transition()
+	return previous != nil
+}
+
+// Starts a transition from the previous ring, and a backfill, if either is
+// enabled. Must be called with the lock held.
+func (r *routes) startTransition(previous, next Router) {
+	if previous.IsEmpty() {
+		return
+	}
+
+	if r.transitionWindow > 0 {
+		r.transition.Store(&ringTransition{previous: previous, ends: time.Now().Add(r.transitionWindow)})
+	}
+	if r.backfillWindow > 0 {
+		r.backfilling = true
+		go r.backfill(previous, next)
+	}
+}
+
+// Copies the last backfillWindow of each series whose token has new replicas,
+// to each of them, from the first of its previous replicas that has it.
+// Replicas come from the topologies alone, so open breakers and load don't
+// change what's copied. Membership can't change until the backfill is done.
+func (r *routes) backfill(previous, next Router) {
+	defer func() {
+		r.Lock()
+		r.backfilling = false
+		r.Unlock()
+	}()
+
+	start := time.Now()
+	var series, points int
+
+	clients := make(map[string]*influx.Client)
+	client := func(host string) *influx.Client {
+		if clients[host] == nil {
+			clients[host] = newInfluxClient(createInfluxDBClient(host, r.clientFunc))
+		}
+		return clients[host]
+	}
+
+	// List every previous host first, so a series can be copied from another
+	// replica when its first one is gone.
+	hosts := previous.Destinations()
+	held := make(map[string]map[string]bool) // Series names by host
+	lists := make(map[string][]string)
+	for _, d := range hosts {
+		if d.Name == "null" {
+			continue
+		}
+		names, err := listSeries(client(d.Name))
+		if err != nil {
+			backfillErrorCounter.Inc(1)
+			logger.Error("ring-backfill", "destination", d.Name, "err", err)
+			continue
+		}
+		lists[d.Name] = names
+		held[d.Name] = make(map[string]bool, len(names))
+		for _, name := range names {
+			held[d.Name][name] = true
+		}
+	}
+
+	for _, from := range hosts {
+		for _, name := range lists[from.Name] {
+			token, ok := tokenFromSeriesName(name)
+			if !ok {
+				continue
+			}
+
+			owners := previous.Owners(token, r.replicationFactor)
+			var source string
+			for _, d := range owners {
+				if held[d.Name][name] {
+					source = d.Name
+					break
+				}
+			}
+			if source != from.Name {
+				continue
+			}
+
+			for _, to := range next.Owners(token, r.replicationFactor) {
+				if to.Name == "null" || containsDestinationNamed(owners, to.Name) {
+					continue
+				}
+
+				n, err := backfillSeries(client(from.Name), client(to.Name), name, r.backfillWindow)
+				if err != nil {
+					backfillErrorCounter.Inc(1)
+					logger.Error("ring-backfill", "series", name, "from", from.Name, "to", to.Name, "err", err)
+					continue
+				}
+				series++
+				points += n
+				backfillSeriesCounter.Inc(1)
+				backfillPointsCounter.Inc(int64(n))
+			}
+		}
+	}
+
+	logger.Info("ring-backfill", "version", next.Version(), "series", series, "points", points, "duration", time.Since(start))
+}
+
+func containsDestinationNamed(destinations []*destination, name string) bool {
+	for _, d := range destinations {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Names of every series on the host.
+func listSeries(client *influx.Client) ([]string, error) {
+	results, err := client.Query("list series")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, result := range results {
+		column := -1
+		for i, c := range result.Columns {
+			if c == "name" {
+				column = i
+			}
+		}
+		if column < 0 {
+			continue
+		}
+		for _, p := range result.Points {
+			if name, ok := p[column].(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// Copies the last window of a series between hosts, returning the number of
+// points copied. Points keep their time and sequence number, so copying the
+// same points twice doesn't duplicate them.
+func backfillSeries(from, to *influx.Client, name string, window time.Duration) (int, error) {
+	query := fmt.Sprintf("select * from \"%s\" where time > now() - %ds", name, int64(window.Seconds()))
+	results, err := from.QueryWithNumbers(query, influx.Microsecond)
+	if err != nil {
+		return 0, err
+	}
+
+	var points int
+	for _, s := range results {
+		points += len(s.Points)
+	}
+	if points == 0 {
+		return 0, nil
+	}
+
+	return points, to.WriteSeriesWithTimePrecision(results, influx.Microsecond)
+}
+
+// Parses the token out of a series name, e.g. "events.router.t.abc" or
+// "skewed.router.rollup.t.abc".
+func tokenFromSeriesName(name string) (string, bool) {
+	name = strings.TrimPrefix(name, "skewed.")
+
+	// Prefer the longest series type, so "router.rollup.t.abc" isn't read as
+	// router with a token of "rollup.t.abc".
+	var typeName string
+	for _, n := range seriesNames {
+		if strings.HasPrefix(name, n+".") && len(n) > len(typeName) {
+			typeName = n
+		}
+	}
+	if typeName == "" || len(name) == len(typeName)+1 {
+		return "", false
+	}
+	return name[len(typeName)+1:], true
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+)
+
+func TestTokenFromSeriesName(t *testing.T) {
+	testCases := map[string]string{
+		"router.t.abc":                "t.abc",
+		"router.rollup.t.abc":         "t.abc",
+		"events.router.rollup.t.abc":  "t.abc",
+		"skewed.dyno.mem.t.abc":       "t.abc",
+		"skewed.router.rollup.t.a.b":  "t.a.b",
+		"list_series_result":          "",
+		"router.":                     "",
+		"continuous.queries.are.here": "",
+	}
+
+	for name, expected := range testCases {
+		token, ok := tokenFromSeriesName(name)
+		if token != expected || ok != (expected != "") {
+			t.Errorf("%s: expected %q, got %q", name, expected, token)
+		}
+	}
+}
+
+func TestTargetDuringTransition(t *testing.T) {
+	routes := newRoutes(newTestClientFunc)
+	routes.transitionWindow = time.Hour
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, routes)
+
+	influxdb := setupInfluxDBTestServer(nil)
+	defer influxdb.Close()
+	defer routes.Close()
+
+	// The first host has no previous topology to transition from.
+	if err := routes.Add("null"); err != nil {
+		t.Fatal(err)
+	}
+	if previous, _ := routes.Transition(); previous != nil {
+		t.Fatal("Expected no transition from an empty ring")
+	}
+
+	if err := routes.Add(extractHostPort(influxdb.URL)); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/target/foo", nil)
+	server.http.Handler.ServeHTTP(recorder, req)
+
+	var target targetResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &target); err != nil {
+		t.Fatal(err)
+	}
+	if len(target.Previous) != 1 || target.Previous[0] != "null" || target.TransitionEnds == nil {
+		t.Errorf("Expected the previous topology to be reported, got %s", recorder.Body.String())
+	}
+
+	// The transition in progress isn't overwritten by another change.
+	if err := routes.Remove("null"); err != errTransitionInProgress {
+		t.Errorf("Expected a change during a transition to be rejected, got %v", err)
+	}
+	if err := routes.SetHosts([]string{"null"}); err != errTransitionInProgress {
+		t.Errorf("Expected a change during a transition to be rejected, got %v", err)
+	}
+}
+
+// An InfluxDB that serves the given series from "list series", returns one
+// point for any select, and records the series written to it.
+type fakeInfluxDB struct {
+	sync.Mutex
+	series  []string
+	written []string
+}
+
+func (f *fakeInfluxDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if r.Method == "POST" {
+		body, _ := ioutil.ReadAll(r.Body)
+		var written []struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(body, &written)
+		for _, s := range written {
+			f.written = append(f.written, s.Name)
+		}
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if q == "list series" {
+		var points [][]interface{}
+		for _, s := range f.series {
+			points = append(points, []interface{}{0, s})
+		}
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"name": "list_series_result", "columns": []string{"time", "name"}, "points": points}})
+		return
+	}
+
+	name := strings.Split(q, "\"")[1]
+	json.NewEncoder(w).Encode([]map[string]interface{}{{"name": name, "columns": []string{"time", "sequence_number", "status"}, "points": [][]interface{}{{1, 1, 200}}}})
+}
+
+func TestBackfill(t *testing.T) {
+	old := &fakeInfluxDB{}
+	for i := 0; i < 50; i++ {
+		old.series = append(old.series, "router.t."+strconv.Itoa(i))
+	}
+	oldServer := httptest.NewTLSServer(old)
+	defer oldServer.Close()
+	added := &fakeInfluxDB{}
+	addedServer := httptest.NewTLSServer(added)
+	defer addedServer.Close()
+
+	oldHost, addedHost := extractHostPort(oldServer.URL), extractHostPort(addedServer.URL)
+	routes := newRoutes(newTestClientFunc)
+	routes.backfillWindow = time.Hour
+	defer routes.Close()
+
+	previous, next := newHashRing(hashRingReplication, nil), newHashRing(hashRingReplication, nil)
+	oldDestination, addedDestination := newDestination(oldHost, 1), newDestination(addedHost, 1)
+	previous.Add(oldDestination)
+	next.Add(oldDestination, addedDestination)
+	routes.ring.Store(Router(next))
+
+	routes.backfill(previous, next)
+
+	if len(added.written) == 0 {
+		t.Fatal("Expected series for moved tokens to be backfilled")
+	}
+	for _, name := range added.written {
+		token, _ := tokenFromSeriesName(name)
+		if next.Get(token) != addedDestination {
+			t.Errorf("%s was backfilled, but its token didn't move", name)
+		}
+	}
+	if len(old.written) != 0 {
+		t.Errorf("Expected nothing to be written to the old host, got %v", old.written)
+	}
+}
+
+func TestBackfillReplicas(t *testing.T) {
+	var names []string
+	for i := 0; i < 50; i++ {
+		names = append(names, "router.t."+strconv.Itoa(i))
+	}
+	fakes := []*fakeInfluxDB{{series: names}, {series: names}, {}}
+	var destinations []*destination
+	for _, f := range fakes {
+		server := httptest.NewTLSServer(f)
+		defer server.Close()
+		destinations = append(destinations, newDestination(extractHostPort(server.URL), 1))
+	}
+
+	routes := newRoutes(newTestClientFunc)
+	routes.replicationFactor = 2
+	routes.backfillWindow = time.Hour
+	defer routes.Close()
+
+	previous, next := newHashRing(hashRingReplication, nil), newHashRing(hashRingReplication, nil)
+	previous.Add(destinations[0], destinations[1])
+	next.Add(destinations...)
+	routes.ring.Store(Router(next))
+
+	// The added host's breaker is open, which mustn't change what's copied.
+	destinations[2].breaker = newCircuitBreaker("added", 0.5, 1, time.Minute, time.Minute, nil)
+	destinations[2].breaker.Failure()
+
+	routes.backfill(previous, next)
+
+	var expected []string
+	for _, name := range names {
+		token, _ := tokenFromSeriesName(name)
+		if containsDestination(next.Owners(token, 2), destinations[2]) {
+			expected = append(expected, name)
+		}
+	}
+	sort.Strings(expected)
+	sort.Strings(fakes[2].written)
+	if len(expected) == 0 || strings.Join(fakes[2].written, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected each series with a new replica to be copied once, expected %v, got %v", expected, fakes[2].written)
+	}
+	if len(fakes[0].written) != 0 || len(fakes[1].written) != 0 {
+		t.Errorf("Expected nothing written to the previous hosts, got %v and %v", fakes[0].written, fakes[1].written)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+// How many of REPLICATION_FACTOR replicas must accept a point for it to count
+// as delivered; if any point of a drain batch falls short, the batch is
+// answered with a 503 so Logplex retries it. Accepted means queued for the
+// replica's posters, or spooled: the drain is answered before points are
+// written, so a replica whose writes later fail still counted. Write failures
+// are counted per destination by the posters.
+type writeConsistency int
+
+const (
+	consistencyAny writeConsistency = iota
+	consistencyQuorum
+	consistencyAll
+)
+
+var (
+	writeConsistencyNames = []string{"any", "quorum", "all"}
+
+	replicationShortfallCounter = metrics.GetOrRegisterCounter("lumbermill.errors.replication.insufficient", metrics.DefaultRegistry)
+	replicationRejectedCounter  = metrics.GetOrRegisterCounter("lumbermill.replication.rejected", metrics.DefaultRegistry)
+	replicaDroppedCounter       = metrics.GetOrRegisterCounter("lumbermill.replication.replica.dropped", metrics.DefaultRegistry)
+)
+
+func (c writeConsistency) Name() string {
+	return writeConsistencyNames[c]
+}
+
+// The number of replicas out of n that must accept a point
+func (c writeConsistency) Required(n int) int {
+	switch c {
+	case consistencyQuorum:
+		return n/2 + 1
+	case consistencyAll:
+		return n
+	}
+	return 1
+}
+
+// Reads REPLICATION_FACTOR and WRITE_CONSISTENCY (any, quorum or all)
+func replicationFromEnv() (int, writeConsistency) {
+	replicas := replicationFactorFromEnv()
+
+	consistency := consistencyAny
+	switch v := os.Getenv("WRITE_CONSISTENCY"); v {
+	case "", "any":
+	case "quorum":
+		consistency = consistencyQuorum
+	case "all":
+		consistency = consistencyAll
+	default:
+		logger.Warn("replication", "err", "unknown write consistency", "value", v, "default", consistencyAny.Name())
+	}
+
+	return replicas, consistency
+}
+
+func replicationFactorFromEnv() int {
+	replicas := envInt("REPLICATION_FACTOR", 1)
+	if replicas < 1 {
+		replicas = 1
+	}
+	return replicas
+}
+
+// Posts the point to every replica. Returns false, and counts a shortfall, if
+// fewer replicas queued it than the write consistency requires of the
+// replication factor, so a ring with fewer hosts than that can fall short.
+// Whether they go on to write it isn't known yet.
+func postToReplicas(replicas []*destination, factor int, p point, consistency writeConsistency) bool {
+	accepted := 0
+	for _, d := range replicas {
+		if d.PostPoint(p) {
+			accepted++
+		} else {
+			replicaDroppedCounter.Inc(1)
+		}
+	}
+
+	if accepted < consistency.Required(factor) {
+		replicationShortfallCounter.Inc(1)
+		return false
+	}
+	return true
+}
+
+// Rejects a drain batch some of whose points too few replicas accepted,
+// asking the sender to retry it. Points that were accepted are written again
+// when it does.
+func (s *server) respondShortfall(w http.ResponseWriter) {
+	replicationRejectedCounter.Inc(1)
+	retryAfter := defaultBackpressureRetryAfter
+	if s.backpressure != nil {
+		retryAfter = s.backpressure.retryAfter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
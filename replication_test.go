@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+)
+
+func TestHashRingGetN(t *testing.T) {
+	hash := newHashRing(3, func(key []byte) uint32 {
+		i, err := strconv.Atoi(string(key))
+		if err != nil {
+			panic(err)
+		}
+		return uint32(i)
+	})
+
+	two := newDestination("2", 1)
+	four := newDestination("4", 1)
+	six := newDestination("6", 1)
+
+	// Replicas with "hashes": 2, 4, 6, 12, 14, 16, 22, 24, 26
+	hash.Add(six, four, two)
+
+	replicas := hash.GetN("23", 2)
+	if len(replicas) != 2 || replicas[0] != four || replicas[1] != six {
+		t.Errorf("Expected [4 6], got %v", replicas)
+	}
+
+	// Asking for more than there are returns each destination once.
+	if replicas := hash.GetN("23", 5); len(replicas) != 3 {
+		t.Errorf("Expected 3 distinct replicas, got %d", len(replicas))
+	}
+}
+
+func TestWriteConsistencyRequired(t *testing.T) {
+	testCases := []struct {
+		consistency writeConsistency
+		replicas    int
+		required    int
+	}{
+		{consistencyAny, 3, 1},
+		{consistencyQuorum, 3, 2},
+		{consistencyQuorum, 4, 3},
+		{consistencyAll, 3, 3},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.consistency.Required(tc.replicas); got != tc.required {
+			t.Errorf("%s of %d: expected %d, got %d", tc.consistency.Name(), tc.replicas, tc.required, got)
+		}
+	}
+}
+
+func TestPostToReplicas(t *testing.T) {
+	accepting := newDestination("accepting", 1)
+	full := newDestination("full", 0)
+	p := point{Token: "token", Type: routerRequest}
+
+	if !postToReplicas([]*destination{accepting, full}, 2, p, consistencyAny) {
+		t.Error("Expected one accepting replica to satisfy any")
+	}
+	if postToReplicas([]*destination{full, newDestination("accepting2", 1)}, 2, p, consistencyAll) {
+		t.Error("Expected a full replica to fail all")
+	}
+	if postToReplicas([]*destination{newDestination("accepting3", 1)}, 3, p, consistencyQuorum) {
+		t.Error("Expected a ring smaller than the replication factor to fail quorum")
+	}
+}
+
+func TestDrainReplicationShortfall(t *testing.T) {
+	routes := newRoutes(newTestClientFunc)
+	routes.Ring().Add(newDestination("d", 10))
+
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, routes)
+	server.replicationFactor, server.writeConsistency = 2, consistencyAll
+
+	line := `<158>1 2014-07-02T00:00:00+00:00 host heroku router - at=info method=GET path="/" host=a request_id=1 fwd="1" dyno=web.1 connect=1ms service=10ms status=200 bytes=10`
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/drain", strings.NewReader(fmt.Sprintf("%d %s", len(line), line)))
+	req.Header.Set("Logplex-Drain-Token", "t.token")
+	server.http.Handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") != "5" {
+		t.Errorf("Expected a 503 with Retry-After, got %d %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
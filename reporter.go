@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+	"github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics/librato"
+)
+
+const (
+	defaultReportInterval = 20 * time.Second
+	reporterTimeout       = 10 * time.Second
+	statsdPacketBytes     = 1432 // Fits in an ethernet MTU
+)
+
+var (
+	defaultReportPercentiles = []float64{0.50, 0.95, 0.99}
+
+	reportErrorCounter = metrics.GetOrRegisterCounter("lumbermill.metrics.report.errors", metrics.DefaultRegistry)
+)
+
+// Sends lumbermill's own metrics somewhere, every interval.
+type metricsReporter interface {
+	Name() string
+	Report(now time.Time, r metrics.Registry) error
+}
+
+// Shared by every reporter.
+type reporterConfig struct {
+	interval    time.Duration
+	percentiles []float64
+	prefix      string            // Prepended to metric names, e.g. "prod"
+	tags        map[string]string // Sent with every metric, where the backend supports it
+}
+
+// Configures reporting from METRICS_INTERVAL, METRICS_PERCENTILES
+// ("0.5,0.95,0.99"), METRICS_PREFIX and the common tags.
+func newReporterConfigFromEnv() reporterConfig {
+	c := reporterConfig{
+		interval:    envDuration("METRICS_INTERVAL", defaultReportInterval),
+		percentiles: defaultReportPercentiles,
+		prefix:      os.Getenv("METRICS_PREFIX"),
+		tags:        commonTagsFromEnv(),
+	}
+
+	if v := os.Getenv("METRICS_PERCENTILES"); v != "" {
+		c.percentiles = nil
+		for _, p := range strings.Split(v, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil || f <= 0 || f >= 1 {
+				logger.Warn("metrics", "err", "percentiles must be between 0 and 1", "percentile", p)
+				continue
+			}
+			c.percentiles = append(c.percentiles, f)
+		}
+		if len(c.percentiles) == 0 {
+			c.percentiles = defaultReportPercentiles
+		}
+	}
+	if c.interval <= 0 {
+		logger.Warn("metrics", "err", "METRICS_INTERVAL must be positive", "interval", c.interval)
+		c.interval = defaultReportInterval
+	}
+	return c
+}
+
+// The tags in METRICS_TAGS ("key1:value1|key2:value2"), plus the dyno and
+// release version when Heroku sets them.
+func commonTagsFromEnv() map[string]string {
+	tags := parseKeyValueList(os.Getenv("METRICS_TAGS"))
+	if dyno := os.Getenv("DYNO"); dyno != "" {
+		tags["dyno"] = dyno
+	}
+	if release := os.Getenv("HEROKU_RELEASE_VERSION"); release != "" {
+		tags["release"] = release
+	}
+	return tags
+}
+
+// Configures the reporters named in METRICS_REPORTERS ("statsd,graphite,otlp").
+// Unset reports to Librato if LIBRATO_TOKEN is set, or logs metrics at debug.
+func newReportersFromEnv(c reporterConfig) []metricsReporter {
+	names := os.Getenv("METRICS_REPORTERS")
+	if names == "" {
+		switch {
+		case os.Getenv("LIBRATO_TOKEN") != "":
+			names = "librato"
+		case logger.Enabled(levelDebug):
+			names = "log"
+		}
+	}
+
+	var reporters []metricsReporter
+	for _, name := range strings.Split(names, ",") {
+		var reporter metricsReporter
+		var err error
+		switch name = strings.TrimSpace(name); name {
+		case "":
+			continue
+		case "librato":
+			reporter = newLibratoReporter(c)
+		case "log":
+			reporter = &logReporter{config: c}
+		case "statsd":
+			reporter, err = newStatsdReporter(c, os.Getenv("STATSD_ADDR"))
+		case "graphite":
+			reporter, err = newGraphiteReporter(c, os.Getenv("GRAPHITE_ADDR"))
+		case "otlp":
+			reporter, err = newOTLPReporter(c, newOTLPExporterFromEnv("metrics"))
+		default:
+			err = fmt.Errorf("unknown reporter %q", name)
+		}
+		if err != nil {
+			logger.Warn("metrics", "reporter", name, "err", err)
+			continue
+		}
+		reporters = append(reporters, reporter)
+	}
+	return reporters
+}
+
+// Reports to each reporter every interval until stop is closed. Reporters run
+// independently, so a slow backend doesn't delay the others.
+func runReporters(reporters []metricsReporter, r metrics.Registry, interval time.Duration, stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	for _, reporter := range reporters {
+		wg.Add(1)
+		go func(reporter metricsReporter) {
+			defer wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case now := <-ticker.C:
+					if err := reporter.Report(now, r); err != nil {
+						reportErrorCounter.Inc(1)
+						logger.Warn("metrics", "reporter", reporter.Name(), "err", err)
+					}
+				case <-stop:
+					return
+				}
+			}
+		}(reporter)
+	}
+	wg.Wait()
+}
+
+type metricKind int
+
+const (
+	metricCounter metricKind = iota // Cumulative count
+	metricGauge
+)
+
+// One value of a metric, flattened out of the registry, e.g. a histogram's
+// p95. Timer values are in milliseconds.
+type metricValue struct {
+	name  string
+	kind  metricKind
+	value float64
+}
+
+// Flattens the registry, sorted by name.
+func (c reporterConfig) values(r metrics.Registry) []metricValue {
+	var values []metricValue
+	add := func(name string, kind metricKind, v float64) {
+		if c.prefix != "" {
+			name = c.prefix + "." + name
+		}
+		values = append(values, metricValue{name, kind, v})
+	}
+	distribution := func(name string, count, min, max int64, mean float64, percentiles []float64, unit float64) {
+		add(name+".count", metricCounter, float64(count))
+		if count == 0 {
+			return
+		}
+		add(name+".min", metricGauge, float64(min)/unit)
+		add(name+".max", metricGauge, float64(max)/unit)
+		add(name+".mean", metricGauge, mean/unit)
+		for i, p := range c.percentiles {
+			add(name+"."+percentileName(p), metricGauge, percentiles[i]/unit)
+		}
+	}
+
+	r.Each(func(name string, i interface{}) {
+		switch m := i.(type) {
+		case metrics.Counter:
+			add(name, metricCounter, float64(m.Count()))
+		case metrics.Gauge:
+			add(name, metricGauge, float64(m.Value()))
+		case metrics.GaugeFloat64:
+			add(name, metricGauge, m.Value())
+		case metrics.Meter:
+			s := m.Snapshot()
+			add(name+".count", metricCounter, float64(s.Count()))
+			add(name+".rate1", metricGauge, s.Rate1())
+		case metrics.Histogram:
+			s := m.Snapshot()
+			distribution(name, s.Count(), s.Min(), s.Max(), s.Mean(), s.Percentiles(c.percentiles), 1)
+		case metrics.Timer:
+			s := m.Snapshot()
+			distribution(name, s.Count(), s.Min(), s.Max(), s.Mean(), s.Percentiles(c.percentiles), float64(time.Millisecond))
+		}
+	})
+
+	sort.Slice(values, func(i, j int) bool { return values[i].name < values[j].name })
+	return values
+}
+
+// "p50", "p95", "p999" for 0.999
+func percentileName(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p*100, 'f', -1, 64), ".", "", 1)
+}
+
+func formatMetricValue(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Librato's legacy source based API, which doesn't take tags. The source is
+// LIBRATO_SOURCE, or the dyno.
+type libratoReporter struct {
+	reporter *librato.Reporter
+	client   *librato.LibratoClient
+}
+
+func newLibratoReporter(c reporterConfig) *libratoReporter {
+	source := os.Getenv("LIBRATO_SOURCE")
+	if source == "" {
+		source = c.tags["dyno"]
+	}
+	return &libratoReporter{
+		reporter: librato.NewReporter(nil, c.interval, os.Getenv("LIBRATO_OWNER"), os.Getenv("LIBRATO_TOKEN"), source, c.percentiles, time.Millisecond),
+		client:   &librato.LibratoClient{Email: os.Getenv("LIBRATO_OWNER"), Token: os.Getenv("LIBRATO_TOKEN")},
+	}
+}
+
+func (l *libratoReporter) Name() string { return "librato" }
+
+func (l *libratoReporter) Report(now time.Time, r metrics.Registry) error {
+	batch, err := l.reporter.BuildRequest(now, r)
+	if err != nil {
+		return err
+	}
+	return l.client.PostMetrics(batch)
+}
+
+// Logs every value, for debugging.
+type logReporter struct {
+	config reporterConfig
+}
+
+func (l *logReporter) Name() string { return "log" }
+
+func (l *logReporter) Report(now time.Time, r metrics.Registry) error {
+	for _, v := range l.config.values(r) {
+		logger.Info("metrics", "metric", v.name, "value", v.value)
+	}
+	return nil
+}
+
+// Sends counters, as the change since the last report, and gauges over UDP,
+// with DogStatsD style tags.
+type statsdReporter struct {
+	config reporterConfig
+	conn   net.Conn
+	tags   string
+	last   map[string]float64 // Counters' values at the last report
+}
+
+func newStatsdReporter(c reporterConfig, addr string) (*statsdReporter, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("STATSD_ADDR is not set")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for k, v := range c.tags {
+		tags = append(tags, k+":"+v)
+	}
+	sort.Strings(tags)
+	s := &statsdReporter{config: c, conn: conn, last: make(map[string]float64)}
+	if len(tags) > 0 {
+		s.tags = "|#" + strings.Join(tags, ",")
+	}
+	return s, nil
+}
+
+func (s *statsdReporter) Name() string { return "statsd" }
+
+func (s *statsdReporter) Report(now time.Time, r metrics.Registry) error {
+	var packet bytes.Buffer
+	send := func(line string) error {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketBytes {
+			if _, err := s.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+		return nil
+	}
+
+	for _, v := range s.config.values(r) {
+		var lines []string
+		switch v.kind {
+		case metricCounter:
+			delta := v.value - s.last[v.name]
+			if delta < 0 { // Cleared
+				delta = v.value
+			}
+			s.last[v.name] = v.value
+			if delta == 0 {
+				continue
+			}
+			lines = []string{v.name + ":" + formatMetricValue(delta) + "|c" + s.tags}
+		case metricGauge:
+			// A signed gauge would be read as a change, so it's reset to 0 first.
+			if v.value < 0 {
+				lines = append(lines, v.name+":0|g"+s.tags)
+			}
+			lines = append(lines, v.name+":"+formatMetricValue(v.value)+"|g"+s.tags)
+		}
+		for _, line := range lines {
+			if err := send(line); err != nil {
+				return err
+			}
+		}
+	}
+
+	if packet.Len() > 0 {
+		_, err := s.conn.Write(packet.Bytes())
+		return err
+	}
+	return nil
+}
+
+// Sends every value over TCP in Graphite's plaintext protocol, with tags in
+// Graphite 1.1's "name;key=value" form.
+type graphiteReporter struct {
+	config reporterConfig
+	addr   string
+	tags   string
+}
+
+func newGraphiteReporter(c reporterConfig, addr string) (*graphiteReporter, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("GRAPHITE_ADDR is not set")
+	}
+
+	var tags []string
+	for k, v := range c.tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	g := &graphiteReporter{config: c, addr: addr}
+	if len(tags) > 0 {
+		g.tags = ";" + strings.Join(tags, ";")
+	}
+	return g, nil
+}
+
+func (g *graphiteReporter) Name() string { return "graphite" }
+
+func (g *graphiteReporter) Report(now time.Time, r metrics.Registry) error {
+	var b bytes.Buffer
+	for _, v := range g.config.values(r) {
+		fmt.Fprintf(&b, "%s%s %s %d\n", v.name, g.tags, formatMetricValue(v.value), now.Unix())
+	}
+
+	conn, err := net.DialTimeout("tcp", g.addr, reporterTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(reporterTimeout))
+	_, err = conn.Write(b.Bytes())
+	return err
+}
+
+// Posts counters as cumulative monotonic sums, and everything else as gauges,
+// to an OpenTelemetry collector. Tags become resource attributes.
+type otlpReporter struct {
+	config   reporterConfig
+	exporter *otlpExporter
+	start    time.Time
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name  string     `json:"name"`
+	Sum   *otlpSum   `json:"sum,omitempty"`
+	Gauge *otlpGauge `json:"gauge,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	StartTimeUnixNano string  `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string  `json:"timeUnixNano"`
+	AsDouble          float64 `json:"asDouble"`
+}
+
+const otlpCumulative = 2 // AGGREGATION_TEMPORALITY_CUMULATIVE
+
+func newOTLPReporter(c reporterConfig, exporter *otlpExporter) (*otlpReporter, error) {
+	if exporter == nil {
+		return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_ENDPOINT is not set")
+	}
+	return &otlpReporter{config: c, exporter: exporter, start: time.Now()}, nil
+}
+
+func (o *otlpReporter) Name() string { return "otlp" }
+
+func (o *otlpReporter) Report(now time.Time, r metrics.Registry) error {
+	values := o.config.values(r)
+	ms := make([]otlpMetric, 0, len(values))
+	for _, v := range values {
+		m := otlpMetric{Name: v.name}
+		switch v.kind {
+		case metricCounter:
+			m.Sum = &otlpSum{
+				DataPoints:             []otlpDataPoint{{StartTimeUnixNano: otlpTime(o.start), TimeUnixNano: otlpTime(now), AsDouble: v.value}},
+				AggregationTemporality: otlpCumulative,
+				IsMonotonic:            true,
+			}
+		case metricGauge:
+			m.Gauge = &otlpGauge{DataPoints: []otlpDataPoint{{TimeUnixNano: otlpTime(now), AsDouble: v.value}}}
+		}
+		ms = append(ms, m)
+	}
+
+	return o.exporter.post(otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResourceFor(o.config.tags),
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "lumbermill"}, Metrics: ms}},
+	}}})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+func newTestReporterConfig() reporterConfig {
+	return reporterConfig{
+		interval:    time.Second,
+		percentiles: []float64{0.5, 0.999},
+		prefix:      "prod",
+		tags:        map[string]string{"dyno": "web.1", "release": "v42"},
+	}
+}
+
+func TestReporterValues(t *testing.T) {
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("lumbermill.batch", r).Inc(3)
+	metrics.GetOrRegisterGauge("lumbermill.ring.version", r).Update(2)
+	metrics.GetOrRegisterHistogram("lumbermill.batches.sizes", r, metrics.NewUniformSample(100)).Update(10)
+	metrics.GetOrRegisterTimer("lumbermill.batches.parse.time", r).Update(5 * time.Millisecond)
+	metrics.GetOrRegisterTimer("lumbermill.poster.success.time.a:8086", r)
+
+	var names []string
+	values := make(map[string]float64)
+	for _, v := range newTestReporterConfig().values(r) {
+		names = append(names, v.name)
+		values[v.name] = v.value
+	}
+
+	expected := []string{
+		"prod.lumbermill.batch",
+		"prod.lumbermill.batches.parse.time.count",
+		"prod.lumbermill.batches.parse.time.max",
+		"prod.lumbermill.batches.parse.time.mean",
+		"prod.lumbermill.batches.parse.time.min",
+		"prod.lumbermill.batches.parse.time.p50",
+		"prod.lumbermill.batches.parse.time.p999",
+		"prod.lumbermill.batches.sizes.count",
+		"prod.lumbermill.batches.sizes.max",
+		"prod.lumbermill.batches.sizes.mean",
+		"prod.lumbermill.batches.sizes.min",
+		"prod.lumbermill.batches.sizes.p50",
+		"prod.lumbermill.batches.sizes.p999",
+		"prod.lumbermill.poster.success.time.a:8086.count",
+		"prod.lumbermill.ring.version",
+	}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+	if values["prod.lumbermill.batches.parse.time.p50"] != 5 {
+		t.Errorf("Expected timers in milliseconds, got %v", values["prod.lumbermill.batches.parse.time.p50"])
+	}
+}
+
+func TestStatsdReporter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := newStatsdReporter(newTestReporterConfig(), conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := metrics.NewRegistry()
+	c := metrics.GetOrRegisterCounter("lumbermill.batch", r)
+	metrics.GetOrRegisterGaugeFloat64("lumbermill.skew.offset", r).Update(-1.5)
+	read := func() string {
+		buf := make([]byte, statsdPacketBytes)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	c.Inc(3)
+	s.Report(time.Now(), r)
+	expected := "prod.lumbermill.batch:3|c|#dyno:web.1,release:v42\nprod.lumbermill.skew.offset:0|g|#dyno:web.1,release:v42\nprod.lumbermill.skew.offset:-1.5|g|#dyno:web.1,release:v42"
+	if p := read(); p != expected {
+		t.Errorf("Expected %q, got %q", expected, p)
+	}
+
+	// Counters are sent as the change since the last report.
+	c.Inc(2)
+	s.Report(time.Now(), r)
+	if p := read(); !strings.HasPrefix(p, "prod.lumbermill.batch:2|c") {
+		t.Errorf("Expected a delta of 2, got %q", p)
+	}
+}
+
+func TestGraphiteReporter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	g, err := newGraphiteReporter(newTestReporterConfig(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("lumbermill.batch", r).Inc(3)
+	if err := g.Report(time.Unix(1404259200, 0), r); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "prod.lumbermill.batch;dyno=web.1;release=v42 3 1404259200\n"
+	if got := <-received; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestOTLPReporter(t *testing.T) {
+	var body otlpMetricsRequest
+	var auth string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer collector.Close()
+
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer abc")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_HEADERS")
+
+	o, err := newOTLPReporter(newTestReporterConfig(), newOTLPExporterFromEnv("metrics"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("lumbermill.batch", r).Inc(3)
+	metrics.GetOrRegisterGauge("lumbermill.ring.version", r).Update(2)
+	if err := o.Report(time.Now(), r); err != nil {
+		t.Fatal(err)
+	}
+
+	if auth != "Bearer abc" {
+		t.Errorf("Expected the configured headers, got %q", auth)
+	}
+	if len(body.ResourceMetrics) != 1 {
+		t.Fatalf("Unexpected request %+v", body)
+	}
+	attributes := body.ResourceMetrics[0].Resource.Attributes
+	if len(attributes) != 3 || *attributes[1].Value.StringValue != "web.1" {
+		t.Errorf("Expected the tags as resource attributes, got %+v", attributes)
+	}
+	ms := body.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(ms) != 2 || ms[0].Sum == nil || !ms[0].Sum.IsMonotonic || ms[0].Sum.DataPoints[0].AsDouble != 3 || ms[1].Gauge == nil {
+		t.Errorf("Unexpected metrics %+v", ms)
+	}
+}
+
+func TestNewReportersFromEnv(t *testing.T) {
+	os.Setenv("METRICS_REPORTERS", "log, graphite,bogus,statsd")
+	os.Setenv("STATSD_ADDR", "127.0.0.1:8125")
+	defer os.Unsetenv("METRICS_REPORTERS")
+	defer os.Unsetenv("STATSD_ADDR")
+
+	var names []string
+	for _, r := range newReportersFromEnv(newTestReporterConfig()) {
+		names = append(names, r.Name())
+	}
+	// Graphite has no address, and bogus isn't a reporter.
+	if strings.Join(names, ",") != "log,statsd" {
+		t.Errorf("Expected log and statsd reporters, got %v", names)
+	}
+}
+
+func TestReporterConfigFromEnvDefaults(t *testing.T) {
+	os.Setenv("METRICS_INTERVAL", "0s")
+	os.Setenv("METRICS_PERCENTILES", "1.5,bogus")
+	defer os.Unsetenv("METRICS_INTERVAL")
+	defer os.Unsetenv("METRICS_PERCENTILES")
+
+	c := newReporterConfigFromEnv()
+	if c.interval != defaultReportInterval {
+		t.Errorf("Expected the default interval, got %s", c.interval)
+	}
+	if len(c.percentiles) != len(defaultReportPercentiles) {
+		t.Errorf("Expected the default percentiles, got %v", c.percentiles)
+	}
+}
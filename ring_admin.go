@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type ringResponse struct {
+	Version      int      `json:"version"`
+	Destinations []string `json:"destinations"`
+}
+
+type ringRequest struct {
+	Hosts []string `json:"hosts"`
+}
+
+// GET    /admin/ring         lists the destinations in the ring
+// PUT    /admin/ring         replaces them with {"hosts": [...]}
+// POST   /admin/ring/<host>  adds a destination
+// DELETE /admin/ring/<host>  removes a destination, once its queue has drained
+func (s *server) serveRing(w http.ResponseWriter, r *http.Request) {
+	host := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/ring"), "/")
+
+	var err error
+	switch {
+	case host == "" && r.Method == "GET":
+	case host == "" && r.Method == "PUT":
+		var req ringRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			badRequestCounter.Inc(1)
+			return
+		}
+		err = s.routes.SetHosts(req.Hosts)
+	case host != "" && r.Method == "POST":
+		err = s.routes.Add(host)
+	case host != "" && r.Method == "DELETE":
+		err = s.routes.Remove(host)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		wrongMethodErrorCounter.Inc(1)
+		return
+	}
+
+	switch err {
+	case nil:
+	case errRouteExists, errTransitionInProgress:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errRouteNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	ring := s.routes.Ring()
+	resp := ringResponse{Version: ring.Version(), Destinations: []string{}}
+	for _, d := range ring.Destinations() {
+		resp.Destinations = append(resp.Destinations, d.Name)
+	}
+
+	response, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		internalServerErrorCounter.Inc(1)
+		return
+	}
+
+	headers := w.Header()
+	headers.Set("Content-Length", fmt.Sprintf("%d", len(response)))
+	headers.Set("Content-Type", "application/json")
+	w.Write(response)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	routerRing       = "ring"
+	routerRendezvous = "rendezvous"
+	routerJump       = "jump"
+)
+
+var routerAlgorithms = []string{routerRing, routerRendezvous, routerJump}
+
+// Maps tokens onto destinations. Routers are built once and never changed
+// after they're shared; changing membership builds a new one.
+type Router interface {
+	// Adds destinations. Not safe to call once the router is in use.
+	Add(destinations ...*destination)
+
+	IsEmpty() bool
+
+	// The distinct destinations, sorted by name
+	Destinations() []*destination
+
+	// The destination for the key, skipping ones whose circuit breaker is
+	// open or whose load is above the bound.
+	Get(key string) *destination
+
+	// The n distinct destinations for the key, in order of preference.
+	GetN(key string, n int) []*destination
+
+	// The n distinct destinations that own the key in the topology alone,
+	// ignoring circuit breakers and load, so they only change with the
+	// version.
+	Owners(key string, n int) []*destination
+
+	// Incremented each time membership changes
+	Version() int
+
+	state() *routerState
+}
+
+// Creates an empty router using the named algorithm.
+func newRouter(algorithm string) (Router, error) {
+	switch algorithm {
+	case routerRing, "":
+		return newHashRing(hashRingReplication, nil), nil
+	case routerRendezvous:
+		return newRendezvousRouter(), nil
+	case routerJump:
+		return newJumpRouter(), nil
+	}
+	return nil, fmt.Errorf("unknown router algorithm %q, expected one of %v", algorithm, routerAlgorithms)
+}
+
+// State and behaviour shared by every Router
+type routerState struct {
+	destinations []*destination // Distinct, in the order they were added
+	version      int
+
+	// When above 0, keys overflow from a destination whose load exceeds
+	// (1+loadBound) times the average load.
+	loadBound float64
+}
+
+func (s *routerState) add(d *destination) {
+	if !containsDestination(s.destinations, d) {
+		s.destinations = append(s.destinations, d)
+	}
+}
+
+func (s *routerState) state() *routerState {
+	return s
+}
+
+func (s *routerState) Version() int {
+	return s.version
+}
+
+// The distinct items, sorted by name.
+func (s *routerState) Destinations() []*destination {
+	destinations := make([]*destination, len(s.destinations))
+	copy(destinations, s.destinations)
+	sort.Sort(destinationsByName(destinations))
+	return destinations
+}
+
+// The load above which a destination is overloaded, or 0 if loads aren't
+// bounded.
+func (s *routerState) maxLoad() int64 {
+	if s.loadBound <= 0 || len(s.destinations) == 0 {
+		return 0
+	}
+
+	var total int64
+	for _, d := range s.destinations {
+		total += d.Load()
+	}
+	average := float64(total) / float64(len(s.destinations))
+
+	bound := int64(math.Ceil((1 + s.loadBound) * average))
+	if bound < minBoundedLoad {
+		bound = minBoundedLoad
+	}
+	return bound
+}
+
+// The first n destinations walk visits.
+func (s *routerState) owners(n int, walk func(visit func(*destination) bool)) []*destination {
+	var owners []*destination
+	walk(func(d *destination) bool {
+		owners = append(owners, d)
+		return len(owners) < n
+	})
+	return owners
+}
+
+// Picks n destinations from those walk visits, in order of preference.
+// Destinations whose circuit breaker is open, or whose load is above the
+// bound, are skipped in favour of the next ones, unless there aren't enough
+// other destinations.
+func (s *routerState) pick(n int, walk func(visit func(*destination) bool)) []*destination {
+	maxLoad := s.maxLoad()
+	overloaded := func(d *destination) bool {
+		return maxLoad > 0 && d.Load() > maxLoad
+	}
+
+	var primary *destination
+	var available, unavailable []*destination
+	walk(func(d *destination) bool {
+		if primary == nil {
+			primary = d
+		}
+		if d.Available() && !overloaded(d) {
+			available = append(available, d)
+		} else {
+			unavailable = append(unavailable, d)
+		}
+		return len(available) < n
+	})
+
+	if len(available) > 0 && available[0] != primary {
+		if primary.Available() {
+			overflowCounter.Inc(1)
+		} else {
+			failoverCounter.Inc(1)
+		}
+	}
+
+	// Not enough is available, so don't make things worse by moving.
+	for len(available) < n && len(unavailable) > 0 {
+		available = append(available, unavailable[0])
+		unavailable = unavailable[1:]
+	}
+
+	return available
+}
+
+// Rendezvous, or highest random weight, hashing: each key prefers the
+// destinations that score highest when hashed together with it. Adding or
+// removing a destination only moves the keys it wins or loses.
+type rendezvousRouter struct {
+	routerState
+}
+
+func newRendezvousRouter() *rendezvousRouter {
+	return &rendezvousRouter{}
+}
+
+func (r *rendezvousRouter) Add(destinations ...*destination) {
+	for _, d := range destinations {
+		r.add(d)
+	}
+}
+
+func (r *rendezvousRouter) IsEmpty() bool {
+	return len(r.destinations) == 0
+}
+
+func (r *rendezvousRouter) Get(key string) *destination {
+	return first(r.GetN(key, 1))
+}
+
+func (r *rendezvousRouter) GetN(key string, n int) []*destination {
+	if r.IsEmpty() || n <= 0 {
+		return nil
+	}
+
+	return r.pick(n, func(visit func(*destination) bool) { r.walk(key, visit) })
+}
+
+func (r *rendezvousRouter) Owners(key string, n int) []*destination {
+	if r.IsEmpty() || n <= 0 {
+		return nil
+	}
+	return r.owners(n, func(visit func(*destination) bool) { r.walk(key, visit) })
+}
+
+// Visits the destinations from highest to lowest score, until visit returns
+// false.
+func (r *rendezvousRouter) walk(key string, visit func(*destination) bool) {
+	scores := make([]uint64, len(r.destinations))
+	order := make([]int, len(r.destinations))
+	for i, d := range r.destinations {
+		scores[i] = hash64(key + "\x00" + d.Name)
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+
+	for _, i := range order {
+		if !visit(r.destinations[i]) {
+			return
+		}
+	}
+}
+
+// Jump consistent hashing (Lamping & Veach): fast and perfectly balanced.
+// Destinations are numbered in the order they were added, which routes keeps
+// as the order they joined the ring. Adding one only moves keys onto it, but
+// removing the i-th of n renumbers those after it, moving about (n-i+1)/n of
+// the keys.
+type jumpRouter struct {
+	routerState
+}
+
+func newJumpRouter() *jumpRouter {
+	return &jumpRouter{}
+}
+
+func (r *jumpRouter) Add(destinations ...*destination) {
+	for _, d := range destinations {
+		r.add(d)
+	}
+}
+
+func (r *jumpRouter) IsEmpty() bool {
+	return len(r.destinations) == 0
+}
+
+func (r *jumpRouter) Get(key string) *destination {
+	return first(r.GetN(key, 1))
+}
+
+func (r *jumpRouter) GetN(key string, n int) []*destination {
+	if r.IsEmpty() || n <= 0 {
+		return nil
+	}
+	return r.pick(n, func(visit func(*destination) bool) { r.walk(key, visit) })
+}
+
+func (r *jumpRouter) Owners(key string, n int) []*destination {
+	if r.IsEmpty() || n <= 0 {
+		return nil
+	}
+	return r.owners(n, func(visit func(*destination) bool) { r.walk(key, visit) })
+}
+
+// The first destination is the key's jump hash bucket. Each further one is
+// jumped to among the destinations not yet visited, with the key rehashed.
+func (r *jumpRouter) walk(key string, visit func(*destination) bool) {
+	remaining := make([]*destination, len(r.destinations))
+	copy(remaining, r.destinations)
+
+	k := key
+	for i := 0; len(remaining) > 0; i++ {
+		if i > 0 {
+			k = key + "\x00" + strconv.Itoa(i)
+		}
+		b := jumpHash(hash64(k), len(remaining))
+		d := remaining[b]
+		remaining = append(remaining[:b], remaining[b+1:]...)
+		if !visit(d) {
+			return
+		}
+	}
+}
+
+// Maps key onto one of buckets buckets.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// FNV-1a, finalised with MurmurHash3's fmix64 so that keys differing only in
+// their last bytes still hash far apart.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	k := h.Sum64()
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+func first(destinations []*destination) *destination {
+	if len(destinations) == 0 {
+		return nil
+	}
+	return destinations[0]
+}
+
+func containsDestination(destinations []*destination, d *destination) bool {
+	for _, dest := range destinations {
+		if dest == d {
+			return true
+		}
+	}
+	return false
+}
+
+type destinationsByName []*destination
+
+func (d destinationsByName) Len() int           { return len(d) }
+func (d destinationsByName) Less(i, j int) bool { return d[i].Name < d[j].Name }
+func (d destinationsByName) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
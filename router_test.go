@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRouters(t *testing.T) {
+	for _, algorithm := range routerAlgorithms {
+		router, err := newRouter(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if router.Get("token") != nil {
+			t.Errorf("%s: expected no destination from an empty router", algorithm)
+		}
+
+		var destinations []*destination
+		for i := 0; i < 4; i++ {
+			destinations = append(destinations, newDestination(algorithm+strconv.Itoa(i), 1))
+		}
+		router.Add(destinations...)
+
+		replicas := router.GetN("token", 3)
+		if len(replicas) != 3 || replicas[0] == replicas[1] || replicas[1] == replicas[2] || replicas[0] == replicas[2] {
+			t.Errorf("%s: expected 3 distinct replicas, got %v", algorithm, replicas)
+		}
+		if router.Get("token") != replicas[0] {
+			t.Errorf("%s: expected Get to return the first replica", algorithm)
+		}
+		if owners := router.Owners("token", 3); !sameDestinations(owners, replicas) {
+			t.Errorf("%s: expected the owners of a healthy router to be its replicas, got %v", algorithm, owners)
+		}
+
+		// Adding a destination only moves keys onto it.
+		added, _ := newRouter(algorithm)
+		added.Add(append(destinations, newDestination(algorithm+"new", 1))...)
+		for i := 0; i < 1000; i++ {
+			key := "t." + strconv.Itoa(i)
+			before, after := router.Get(key), added.Get(key)
+			if before != after && after.Name != algorithm+"new" {
+				t.Errorf("%s: %s moved from %s to %s", algorithm, key, before.Name, after.Name)
+				break
+			}
+		}
+	}
+
+	if _, err := newRouter("modulo"); err == nil {
+		t.Error("Expected an unknown algorithm to be an error")
+	}
+}
+
+func TestRingSimulate(t *testing.T) {
+	var tokens bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		tokens.WriteString("t." + strconv.Itoa(i) + " 2\n")
+	}
+
+	var out bytes.Buffer
+	if err := ringCommand([]string{"simulate", "-hosts", "a,b,c"}, &tokens, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2+len(routerAlgorithms) {
+		t.Fatalf("Expected a header, a line per algorithm and the ideal, got:\n%s", out.String())
+	}
+	if !strings.HasPrefix(lines[1], "ring ") || !strings.Contains(lines[0], "moved -a") {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
+
+func TestRingSimulateJumpAddsLast(t *testing.T) {
+	sim, err := simulateRouter("jump", []string{"web-a", "web-b", "web-c", "web-d"}, "web-a", syntheticTokens(20000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sim.addMoved > 25 {
+		t.Errorf("Expected about a fifth of tokens to move to a host joining last, got %.1f%%", sim.addMoved)
+	}
+}
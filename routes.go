@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	influx "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/influxdb/influxdb-go"
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+var (
+	errRouteExists   = errors.New("destination is already in the ring")
+	errRouteNotFound = errors.New("destination is not in the ring")
+	errRoutesClosed  = errors.New("shutting down")
+	errPosterCount   = errors.New("poster count must be at least 1")
+
+	errTransitionInProgress = errors.New("a ring transition is in progress")
+
+	ringVersionGauge = metrics.GetOrRegisterGauge("lumbermill.ring.version", metrics.DefaultRegistry)
+)
+
+// A destination and the posters delivering its points
+type route struct {
+	destination *destination
+	client      influx.ClientConfig
+	joined      int64 // Order the route was added in, for routers that number destinations
+	posters     *sync.WaitGroup
+	stops       []chan struct{} // One per running poster; closing it stops the poster
+}
+
+// The destinations points are delivered to, and the ring that maps tokens onto
+// them. Destinations can be added and removed at runtime: each change builds a
+// new ring and swaps it in atomically, so requests in flight keep using the
+// ring they started with.
+type routes struct {
+	sync.Mutex               // Serialises changes
+	ring        atomic.Value // Router
+	clientFunc  clientFunc
+	routes      map[string]*route // By host
+	blackhole   bool              // Deliver to a null destination when there are no hosts
+	null        *route
+	posterGroup *sync.WaitGroup // Every poster, for shutdown
+	closed      bool
+	joins       int64
+	loadBound   float64 // See routerState.loadBound
+	algorithm   string
+
+	replicationFactor int
+	transition        atomic.Value // *ringTransition
+	transitionWindow  time.Duration
+	backfillWindow    time.Duration
+	backfilling       bool
+}
+
+func newRoutes(f clientFunc) *routes {
+	r := &routes{
+		clientFunc:  f,
+		routes:      make(map[string]*route),
+		posterGroup: new(sync.WaitGroup),
+		loadBound:   envFloat("RING_LOAD_BOUND", 0),
+		algorithm:   os.Getenv("RING_ALGORITHM"),
+
+		replicationFactor: replicationFactorFromEnv(),
+		transitionWindow:  envDuration("RING_TRANSITION", 0),
+		backfillWindow:    envDuration("RING_BACKFILL", 0),
+	}
+	if _, err := newRouter(r.algorithm); err != nil {
+		logger.Warn("routes", "err", err, "default", routerRing)
+		r.algorithm = routerRing
+	}
+	r.swapRing()
+	return r
+}
+
+// The current ring. Don't hold on to it beyond a request.
+func (r *routes) Ring() Router {
+	return r.ring.Load().(Router)
+}
+
+// The current destinations, sorted by name
+func (r *routes) Destinations() []*destination {
+	return r.Ring().Destinations()
+}
+
+// Builds a ring from the current routes and swaps it in. Must be called with
+// the lock held, or before the routes are shared.
+func (r *routes) swapRing() {
+	ring, _ := newRouter(r.algorithm)
+	ring.state().loadBound = r.loadBound
+
+	// In the order they joined, which jump hashing numbers destinations by.
+	var hosts []string
+	for host := range r.routes {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return r.routes[hosts[i]].joined < r.routes[hosts[j]].joined })
+	for _, host := range hosts {
+		ring.Add(r.routes[host].destination)
+	}
+
+	if len(hosts) == 0 && r.blackhole {
+		if r.null == nil {
+			// No backends, so blackhole things
+			destination := newDestination("null", pointChannelCapacity)
+			go newNullPoster(destination).Run()
+			r.null = &route{destination: destination, posters: new(sync.WaitGroup)}
+		}
+		ring.Add(r.null.destination)
+	}
+
+	current, ok := r.ring.Load().(Router)
+	if ok {
+		ring.state().version = current.Version() + 1
+	}
+	r.ring.Store(ring)
+	if ok {
+		r.startTransition(current, ring)
+	}
+	ringVersionGauge.Update(int64(ring.Version()))
+}
+
+// Starts delivering to a new InfluxDB host and adds it to the ring.
+func (r *routes) Add(host string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return errRoutesClosed
+	}
+	if _, exists := r.routes[host]; exists {
+		return errRouteExists
+	}
+	if r.transitioning() {
+		return errTransitionInProgress
+	}
+
+	r.routes[host] = r.newRoute(createInfluxDBClient(host, r.clientFunc))
+	r.swapRing()
+	logger.Info("ring-add", "destination", host, "version", r.Ring().Version())
+	return nil
+}
+
+// Removes an InfluxDB host from the ring, then waits for its posters to
+// deliver the points already queued for it before closing it.
+func (r *routes) Remove(host string) error {
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return errRoutesClosed
+	}
+	route, exists := r.routes[host]
+	if !exists {
+		r.Unlock()
+		return errRouteNotFound
+	}
+	if r.transitioning() {
+		r.Unlock()
+		return errTransitionInProgress
+	}
+	delete(r.routes, host)
+	r.swapRing()
+	logger.Info("ring-remove", "destination", host, "version", r.Ring().Version())
+	r.Unlock()
+
+	route.close()
+	return nil
+}
+
+// Adds and removes hosts so the ring contains exactly the given ones, as a
+// single membership change. New hosts join in the order given.
+func (r *routes) SetHosts(hosts []string) error {
+	want := make(map[string]bool)
+	for _, host := range hosts {
+		want[host] = true
+	}
+
+	r.Lock()
+	var add []string
+	var remove []*route
+	adding := make(map[string]bool)
+	for _, host := range hosts {
+		if _, exists := r.routes[host]; !exists && !adding[host] {
+			add = append(add, host)
+			adding[host] = true
+		}
+	}
+	for host, route := range r.routes {
+		if !want[host] {
+			remove = append(remove, route)
+		}
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		r.Unlock()
+		return nil
+	}
+	if r.closed {
+		r.Unlock()
+		return errRoutesClosed
+	}
+	if r.transitioning() {
+		r.Unlock()
+		return errTransitionInProgress
+	}
+
+	for _, host := range add {
+		r.routes[host] = r.newRoute(createInfluxDBClient(host, r.clientFunc))
+	}
+	for _, route := range remove {
+		delete(r.routes, route.destination.Name)
+	}
+	r.swapRing()
+	logger.Info("ring-set", "added", len(add), "removed", len(remove), "version", r.Ring().Version())
+	r.Unlock()
+
+	for _, route := range remove {
+		route.close()
+	}
+	return nil
+}
+
+func (r *routes) newRoute(client influx.ClientConfig) *route {
+	name := client.Host
+	destination := newDestination(name, pointChannelCapacity)
+	destination.aggregator = newAggregatorFromEnv()
+	influxClient := newInfluxClient(client)
+	destination.spool = newSpoolFromEnv(name, newSpoolWriter(influxClient))
+	if destination.spool != nil {
+		go destination.spool.Run(destination.waitWhilePaused)
+	}
+	destination.breaker = newCircuitBreakerFromEnv(name, influxClient.Ping)
+	if destination.breaker != nil {
+		go destination.breaker.Run()
+	}
+
+	r.joins++
+	route := &route{destination: destination, client: client, joined: r.joins, posters: new(sync.WaitGroup)}
+	route.setPosters(envInt("POSTERS_PER_HOST", postersPerHost), r.posterGroup)
+	return route
+}
+
+// Starts or stops posters until n are running. Stopped posters deliver the
+// batch they're collecting before exiting.
+func (rt *route) setPosters(n int, group *sync.WaitGroup) {
+	for len(rt.stops) < n {
+		poster := newPoster(rt.client, rt.destination.Name, rt.destination, group)
+		poster.stop = make(chan struct{})
+		rt.stops = append(rt.stops, poster.stop)
+		group.Add(1)
+		rt.posters.Add(1)
+		go func() {
+			poster.Run()
+			rt.posters.Done()
+			group.Done()
+		}()
+	}
+	for len(rt.stops) > n {
+		close(rt.stops[len(rt.stops)-1])
+		rt.stops = rt.stops[:len(rt.stops)-1]
+	}
+}
+
+// Changes how many posters deliver to an InfluxDB host.
+func (r *routes) SetPosters(host string, n int) error {
+	if n < 1 {
+		return errPosterCount
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return errRoutesClosed
+	}
+	route, exists := r.routes[host]
+	if !exists {
+		return errRouteNotFound
+	}
+	route.setPosters(n, r.posterGroup)
+	logger.Info("destination-posters", "destination", host, "posters", n)
+	return nil
+}
+
+// Closes the destination and waits for its posters to drain it.
+func (rt *route) close() {
+	rt.destination.Close()
+	rt.posters.Wait()
+	rt.destination.spool.Close()
+	rt.destination.breaker.Close()
+}
+
+// Closes every destination, so their posters deliver what's queued and exit.
+// Spools are flushed and closed by the lifecycle once the posters are done.
+func (r *routes) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.closed = true
+	for _, route := range r.routes {
+		route.destination.Close()
+	}
+	if r.null != nil {
+		r.null.destination.Close()
+	}
+	return nil
+}
+
+// Waits for every poster to finish.
+func (r *routes) Wait() {
+	r.posterGroup.Wait()
+}
+
+// The InfluxDB hosts to deliver to, from the file named by INFLUXDB_HOSTS_FILE
+// if set, otherwise from INFLUXDB_HOSTS. Hosts are separated by commas or
+// whitespace.
+func hostsFromEnv() ([]string, error) {
+	hostlist := os.Getenv("INFLUXDB_HOSTS")
+	if file := os.Getenv("INFLUXDB_HOSTS_FILE"); file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		hostlist = string(b)
+	}
+
+	return strings.FieldsFunc(hostlist, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}), nil
+}
+
+// Re-reads the host list on SIGHUP and updates the ring to match it.
+func (r *routes) reloadOn(signals <-chan os.Signal) {
+	for sig := range signals {
+		hosts, err := hostsFromEnv()
+		if err != nil {
+			logger.Error("ring-reload", "signal", sig, "err", err)
+			continue
+		}
+		if err := r.SetHosts(hosts); err != nil {
+			logger.Error("ring-reload", "signal", sig, "err", err)
+			continue
+		}
+		logger.Info("ring-reload", "signal", sig, "hosts", len(hosts), "version", r.Ring().Version())
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+)
+
+func TestRoutesAddRemove(t *testing.T) {
+	var writes int32
+	influxdb := setupInfluxDBTestServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&writes, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer influxdb.Close()
+	host := extractHostPort(influxdb.URL)
+
+	routes := newRoutes(newTestClientFunc)
+	if !routes.Ring().IsEmpty() {
+		t.Fatal("Expected an empty ring")
+	}
+
+	if err := routes.Add(host); err != nil {
+		t.Fatal(err)
+	}
+	if err := routes.Add(host); err != errRouteExists {
+		t.Errorf("Expected errRouteExists, got %v", err)
+	}
+
+	ring := routes.Ring()
+	d := ring.Get("token")
+	if d == nil || d.Name != host {
+		t.Fatalf("Expected %s to be in the ring", host)
+	}
+	d.PostPoint(point{Token: "token", Type: routerRequest, Points: []interface{}{int64(1), 200, 1, 1}})
+
+	// Removing the destination drains its queue before returning.
+	if err := routes.Remove(host); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&writes) == 0 {
+		t.Error("Expected the queued point to be delivered before the destination was closed")
+	}
+	if !routes.Ring().IsEmpty() || routes.Ring().Version() <= ring.Version() {
+		t.Error("Expected a new, empty ring")
+	}
+
+	// Requests still holding the old ring don't panic posting to it.
+	if d.PostPoint(point{Token: "token", Type: routerRequest}) {
+		t.Error("Expected posting to a removed destination to fail")
+	}
+
+	if err := routes.Remove(host); err != errRouteNotFound {
+		t.Errorf("Expected errRouteNotFound, got %v", err)
+	}
+
+	// Nothing changes once the routes are closed for shutdown.
+	routes.Add(host)
+	routes.Close()
+	if err := routes.Remove(host); err != errRoutesClosed {
+		t.Errorf("Expected errRoutesClosed, got %v", err)
+	}
+}
+
+func TestServeRing(t *testing.T) {
+	influxdb := setupInfluxDBTestServer(nil)
+	defer influxdb.Close()
+	host := extractHostPort(influxdb.URL)
+
+	routes := newRoutes(newTestClientFunc)
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, routes)
+
+	testCases := []struct {
+		method, path, body string
+		status             int
+		response           string
+	}{
+		{"POST", "/admin/ring/" + host, "", http.StatusOK, `{"version":1,"destinations":["` + host + `"]}`},
+		{"POST", "/admin/ring/" + host, "", http.StatusConflict, ""},
+		{"GET", "/admin/ring", "", http.StatusOK, `{"version":1,"destinations":["` + host + `"]}`},
+		{"DELETE", "/admin/ring/" + host, "", http.StatusOK, `{"version":2,"destinations":[]}`},
+		{"DELETE", "/admin/ring/" + host, "", http.StatusNotFound, ""},
+		{"PUT", "/admin/ring", `{"hosts": ["` + host + `"]}`, http.StatusOK, `{"version":3,"destinations":["` + host + `"]}`},
+		{"PUT", "/admin/ring", `{"hosts": `, http.StatusBadRequest, ""},
+	}
+
+	for _, tc := range testCases {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest(tc.method, tc.path, bytes.NewReader([]byte(tc.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server.http.Handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.status {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.status, recorder.Code)
+		}
+		if tc.response != "" && recorder.Body.String() != tc.response {
+			t.Errorf("%s %s: expected %s, got %s", tc.method, tc.path, tc.response, recorder.Body.String())
+		}
+	}
+
+	routes.Close()
+	done := make(chan struct{})
+	go func() {
+		routes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for posters to exit")
+	}
+}
+
+func TestRoutesJoinOrder(t *testing.T) {
+	os.Setenv("RING_ALGORITHM", routerJump)
+	defer os.Unsetenv("RING_ALGORITHM")
+	routes := createMessageRoutes("zeta:8086,alpha:8086", newTestClientFunc)
+	defer routes.Close()
+	routes.SetHosts([]string{"zeta:8086", "alpha:8086", "mid:8086", "beta:8086"})
+
+	// Jump hashing numbers destinations in the order they joined, not by name.
+	var names []string
+	for _, d := range routes.Ring().state().destinations {
+		names = append(names, d.Name)
+	}
+	if strings.Join(names, ",") != "zeta:8086,alpha:8086,mid:8086,beta:8086" {
+		t.Errorf("Expected destinations in join order, got %v", names)
+	}
+}
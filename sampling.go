@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strconv"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+var (
+	sampledOutCounter = metrics.GetOrRegisterCounter("lumbermill.sampling.router.dropped", metrics.DefaultRegistry)
+)
+
+// Per token sampling of router request points. Whether a request is kept
+// depends only on a hash of its request_id, so a retried drain keeps (or
+// drops) the same requests. 5xx responses are always kept, and router errors
+// are never sampled.
+type routerSampler struct {
+	defaultRate float64
+	rates       map[string]float64
+}
+
+// Configures a sampler from ROUTER_SAMPLE_RATE (0-1) and ROUTER_SAMPLE_RATES
+// ("token1:0.1|token2:0.5"). Returns nil if every request is kept.
+func newRouterSamplerFromEnv() *routerSampler {
+	s := &routerSampler{
+		defaultRate: validSampleRate("default", envFloat("ROUTER_SAMPLE_RATE", 1)),
+		rates:       make(map[string]float64),
+	}
+	for token, v := range parseKeyValueList(os.Getenv("ROUTER_SAMPLE_RATES")) {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			logger.Warn("sampling", "err", err, "token", token, "rate", v)
+			continue
+		}
+		s.rates[token] = validSampleRate(token, rate)
+	}
+
+	if s.defaultRate >= 1 && len(s.rates) == 0 {
+		return nil
+	}
+	return s
+}
+
+func validSampleRate(token string, rate float64) float64 {
+	if rate <= 0 || rate > 1 {
+		logger.Warn("sampling", "err", "rate must be above 0 and at most 1", "token", token, "rate", rate)
+		return 1
+	}
+	return rate
+}
+
+// The token's configured sample rate.
+func (s *routerSampler) Rate(token string) float64 {
+	if s == nil {
+		return 1
+	}
+	if rate, ok := s.rates[token]; ok {
+		return rate
+	}
+	return s.defaultRate
+}
+
+// Whether a router request should be posted, and the rate it was sampled at.
+// Requests without a request_id can't be sampled consistently, so are kept.
+func (s *routerSampler) Sample(token, requestID string, status int) (float64, bool) {
+	rate := s.Rate(token)
+	if rate >= 1 || status >= 500 || requestID == "" {
+		return 1, true
+	}
+	if float64(hash64(requestID))/math.MaxUint64 < rate {
+		return rate, true
+	}
+	sampledOutCounter.Inc(1)
+	return rate, false
+}
+
+// How many requests a router request point stands for: the inverse of the
+// sample rate stored with it, or 1 for points without one.
+func sampleWeight(p point) float64 {
+	if p.Type != routerRequest || len(p.Points) <= 4 {
+		return 1
+	}
+	if rate, ok := p.Points[4].(float64); ok && rate > 0 && rate < 1 {
+		return 1 / rate
+	}
+	return 1
+}
+
+// Rounds a weighted count to the nearest whole number of requests.
+func roundCount(f float64) int {
+	return int(math.Floor(f + 0.5))
+}
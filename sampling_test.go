@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRouterSampler(t *testing.T) {
+	s := &routerSampler{defaultRate: 1, rates: map[string]float64{"sampled": 0.1}}
+
+	if rate, keep := s.Sample("other", "abc", 200); !keep || rate != 1 {
+		t.Errorf("Expected unsampled tokens to keep everything, got %v %v", rate, keep)
+	}
+
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("request-%d", i)
+		rate, keep := s.Sample("sampled", id, 200)
+		if rate != 0.1 {
+			t.Fatalf("Expected a rate of 0.1, got %v", rate)
+		}
+		if _, again := s.Sample("sampled", id, 200); again != keep {
+			t.Fatalf("Expected %s to be sampled consistently", id)
+		}
+		if keep {
+			kept++
+		}
+
+		if rate, keep := s.Sample("sampled", id, 503); !keep || rate != 1 {
+			t.Fatalf("Expected 5xx responses to always be kept, got %v %v", rate, keep)
+		}
+	}
+	if kept < 900 || kept > 1100 {
+		t.Errorf("Expected about 1000 of 10000 requests to be kept, got %d", kept)
+	}
+
+	var nilSampler *routerSampler
+	if rate, keep := nilSampler.Sample("sampled", "abc", 200); !keep || rate != 1 {
+		t.Errorf("Expected a nil sampler to keep everything, got %v %v", rate, keep)
+	}
+}
+
+func TestRollupsScaleSampledRequests(t *testing.T) {
+	bucket := int64(1404259200000000)
+	points := []point{
+		{Token: "foo", Type: routerRequest, Points: []interface{}{bucket, 200, 10, 1, 0.1}},
+		{Token: "foo", Type: routerRequest, Points: []interface{}{bucket, 200, 20, 1, 0.1}},
+		{Token: "foo", Type: routerRequest, Points: []interface{}{bucket, 503, 1000, 1, 1.0}},
+		{Token: "foo", Type: routerRequest, Points: []interface{}{bucket, 200, 30, 1}}, // Written before sampling
+	}
+
+	rollup := newAggregator(newRollupStage(10*time.Second, true, rollupFactories[routerRequest], routerRequest))
+	sketches := newAggregator(newRollupStage(10*time.Second, false, newRouterSketchState, routerRequest))
+	for _, p := range points {
+		rollup.Add(p)
+		sketches.Add(p)
+	}
+
+	r := rollup.Flush()[0]
+	expected := map[string]interface{}{"count": 22, "status_2xx": 21, "status_5xx": 1, "service_p50": 20, "service_p95": 30, "service_p99": 1000}
+	for i, c := range seriesColumns[routerRollup] {
+		if v, ok := expected[c]; ok && r.Points[i] != v {
+			t.Errorf("column %s: expected %v, got %v", c, v, r.Points[i])
+		}
+	}
+
+	if count := sketches.Flush()[0].Points[1]; count != uint64(22) {
+		t.Errorf("Expected the sketch to count 22 requests, got %v", count)
+	}
+}
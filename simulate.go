@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type simulatedToken struct {
+	token  string
+	weight float64
+}
+
+type simulation struct {
+	algorithm string
+	hosts     int
+	maxPct    float64 // Busiest host's share, as a percentage of the average
+	minPct    float64 // Idlest host's share, as a percentage of the average
+	stddevPct float64 // Standard deviation of the shares, as a percentage of the average
+	addMoved  float64 // Percentage of weight that moves when a host is added
+	delMoved  float64 // Percentage of weight that moves when a host is removed
+}
+
+// lumbermill ring simulate [-algorithms list] [-hosts n|list] [-remove host] [-synthetic n]
+//
+// Reads a token population from stdin, one "<token> [weight]" per line (e.g.
+// points per minute), and reports for each algorithm how evenly the weight is
+// spread across hosts, and how much of it moves to a different host when a
+// host is added or removed.
+func ringCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "simulate" {
+		return fmt.Errorf("usage: lumbermill ring simulate [-algorithms list] [-hosts n|list] [-remove host] [-synthetic n]")
+	}
+
+	flags := flag.NewFlagSet("ring simulate", flag.ContinueOnError)
+	algorithms := flags.String("algorithms", strings.Join(routerAlgorithms, ","), "comma separated router algorithms to compare")
+	hostsFlag := flags.String("hosts", "4", "number of hosts, or comma separated host names")
+	remove := flags.String("remove", "", "host to remove (default the first)")
+	synthetic := flags.Int("synthetic", 0, "simulate this many random tokens instead of reading stdin")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	hosts := strings.Split(*hostsFlag, ",")
+	if n, err := strconv.Atoi(*hostsFlag); err == nil {
+		hosts = nil
+		for i := 1; i <= n; i++ {
+			hosts = append(hosts, fmt.Sprintf("host-%d", i))
+		}
+	}
+	if len(hosts) < 2 {
+		return fmt.Errorf("at least 2 hosts are needed to simulate removing one")
+	}
+	if *remove == "" {
+		*remove = hosts[0]
+	}
+
+	var tokens []simulatedToken
+	if *synthetic > 0 {
+		tokens = syntheticTokens(*synthetic)
+	} else {
+		var err error
+		if tokens, err = readSimulatedTokens(stdin); err != nil {
+			return err
+		}
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("no tokens to simulate")
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "algorithm\thosts\ttokens\tmax/avg\tmin/avg\tstddev/avg\tmoved +1 host\tmoved -%s\n", *remove)
+	for _, algorithm := range strings.Split(*algorithms, ",") {
+		sim, err := simulateRouter(strings.TrimSpace(algorithm), hosts, *remove, tokens)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t%.1f%%\t%.1f%%\t%.1f%%\t%.1f%%\n",
+			sim.algorithm, sim.hosts, len(tokens), sim.maxPct, sim.minPct, sim.stddevPct, sim.addMoved, sim.delMoved)
+	}
+	fmt.Fprintf(w, "ideal\t%d\t%d\t100.0%%\t100.0%%\t0.0%%\t%.1f%%\t%.1f%%\n",
+		len(hosts), len(tokens), 100/float64(len(hosts)+1), 100/float64(len(hosts)))
+	return w.Flush()
+}
+
+// Reads "<token> [weight]" lines. Tokens without a weight weigh 1.
+func readSimulatedTokens(r io.Reader) ([]simulatedToken, error) {
+	var tokens []simulatedToken
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		t := simulatedToken{token: fields[0], weight: 1}
+		if len(fields) > 1 {
+			w, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight for %s: %s", fields[0], err)
+			}
+			t.weight = w
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, scanner.Err()
+}
+
+// Random tokens with a long tailed weight, since a few apps log far more than
+// the rest.
+func syntheticTokens(n int) []simulatedToken {
+	rnd := rand.New(rand.NewSource(1))
+	tokens := make([]simulatedToken, n)
+	for i := range tokens {
+		tokens[i] = simulatedToken{
+			token:  fmt.Sprintf("t.%08x-%04x", rnd.Uint32(), rnd.Intn(1<<16)),
+			weight: math.Floor(math.Exp(rnd.ExpFloat64()*0.5)) + 1,
+		}
+	}
+	return tokens
+}
+
+func simulateRouter(algorithm string, hosts []string, remove string, tokens []simulatedToken) (simulation, error) {
+	build := func(names []string) (Router, error) {
+		router, err := newRouter(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		// Hosts join in the order given, as they do in production, so the
+		// new host joins last.
+		for _, name := range names {
+			router.Add(newDestination(name, 0))
+		}
+		return router, nil
+	}
+
+	router, err := build(hosts)
+	if err != nil {
+		return simulation{}, err
+	}
+
+	var without []string
+	for _, h := range hosts {
+		if h != remove {
+			without = append(without, h)
+		}
+	}
+	added, _ := build(append(append([]string(nil), hosts...), "host-new"))
+	removed, _ := build(without)
+
+	sim := simulation{algorithm: algorithm, hosts: len(hosts)}
+	shares := make(map[string]float64)
+	for _, h := range hosts {
+		shares[h] = 0
+	}
+
+	var total, addMoved, delMoved float64
+	for _, t := range tokens {
+		primary := router.Get(t.token).Name
+		shares[primary] += t.weight
+		total += t.weight
+
+		if added.Get(t.token).Name != primary {
+			addMoved += t.weight
+		}
+		if removed.Get(t.token).Name != primary {
+			delMoved += t.weight
+		}
+	}
+	if total == 0 {
+		return sim, nil
+	}
+
+	average := total / float64(len(hosts))
+	sim.minPct = math.Inf(1)
+	var variance float64
+	for _, share := range shares {
+		pct := share / average * 100
+		sim.maxPct = math.Max(sim.maxPct, pct)
+		sim.minPct = math.Min(sim.minPct, pct)
+		variance += (pct - 100) * (pct - 100)
+	}
+	sim.stddevPct = math.Sqrt(variance / float64(len(hosts)))
+	sim.addMoved = addMoved / total * 100
+	sim.delMoved = delMoved / total * 100
+	return sim, nil
+}
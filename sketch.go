@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+const (
+	defaultSketchAccuracy = 0.01
+	sketchVersion         = 1
+)
+
+var (
+	errSketchVersion  = errors.New("unknown sketch version")
+	errSketchAccuracy = errors.New("sketches have different relative accuracy")
+	errSketchRange    = errors.New("sketch accuracy must be between 0 and 1")
+)
+
+// A DDSketch: a quantile sketch with relative error guarantees that can be
+// merged with other sketches of the same accuracy. Values are bucketed by the
+// logarithm of their magnitude, so p99 from a merge of sketches from several
+// lumbermills (or several intervals) is as accurate as from a single one.
+type sketch struct {
+	accuracy float64
+	gamma    float64
+	logGamma float64
+	zeros    uint64 // Values <= 0
+	count    uint64
+	bins     map[int]uint64
+}
+
+func newSketch(accuracy float64) *sketch {
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &sketch{
+		accuracy: accuracy,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		bins:     make(map[int]uint64),
+	}
+}
+
+func (s *sketch) Add(v float64) {
+	s.AddN(v, 1)
+}
+
+// Adds n occurrences of v.
+func (s *sketch) AddN(v float64, n uint64) {
+	s.count += n
+	if v <= 0 {
+		s.zeros += n
+		return
+	}
+	s.bins[int(math.Ceil(math.Log(v)/s.logGamma))] += n
+}
+
+func (s *sketch) Count() uint64 {
+	return s.count
+}
+
+// Returns the approximate value at quantile q (0 <= q <= 1).
+func (s *sketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return math.NaN()
+	}
+
+	rank := uint64(q * float64(s.count-1))
+	if rank < s.zeros {
+		return 0
+	}
+
+	seen := s.zeros
+	for _, idx := range s.indexes() {
+		seen += s.bins[idx]
+		if seen > rank {
+			return 2 * math.Pow(s.gamma, float64(idx)) / (s.gamma + 1)
+		}
+	}
+	return math.NaN()
+}
+
+// Adds the contents of o to the sketch.
+func (s *sketch) Merge(o *sketch) error {
+	if s.accuracy != o.accuracy {
+		return errSketchAccuracy
+	}
+
+	s.zeros += o.zeros
+	s.count += o.count
+	for idx, c := range o.bins {
+		s.bins[idx] += c
+	}
+	return nil
+}
+
+func (s *sketch) indexes() []int {
+	indexes := make([]int, 0, len(s.bins))
+	for idx := range s.bins {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// Serialises the sketch into a base64 string suitable for a series column:
+// version, accuracy, zero count, bin count, then delta encoded bin indexes and
+// their counts.
+func (s *sketch) String() string {
+	var buf bytes.Buffer
+	tmp := make([]byte, binary.MaxVarintLen64)
+
+	buf.WriteByte(sketchVersion)
+	binary.Write(&buf, binary.BigEndian, s.accuracy)
+	buf.Write(tmp[:binary.PutUvarint(tmp, s.zeros)])
+	buf.Write(tmp[:binary.PutUvarint(tmp, uint64(len(s.bins)))])
+
+	last := 0
+	for _, idx := range s.indexes() {
+		buf.Write(tmp[:binary.PutVarint(tmp, int64(idx-last))])
+		buf.Write(tmp[:binary.PutUvarint(tmp, s.bins[idx])])
+		last = idx
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// Parses a sketch serialised by sketch.String.
+func parseSketch(encoded string) (*sketch, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(data)
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != sketchVersion {
+		return nil, errSketchVersion
+	}
+
+	var accuracy float64
+	if err := binary.Read(r, binary.BigEndian, &accuracy); err != nil {
+		return nil, err
+	}
+	if !(accuracy > 0 && accuracy < 1) {
+		return nil, errSketchRange
+	}
+
+	s := newSketch(accuracy)
+	if s.zeros, err = binary.ReadUvarint(r); err != nil {
+		return nil, err
+	}
+	s.count = s.zeros
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := 0
+	for i := uint64(0); i < n; i++ {
+		delta, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		c, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		idx += int(delta)
+		s.bins[idx] = c
+		s.count += c
+	}
+
+	return s, nil
+}
+
+// Parses and merges serialised sketches.
+func mergeSketches(encoded []string) (*sketch, error) {
+	var merged *sketch
+	for _, e := range encoded {
+		s, err := parseSketch(e)
+		if err != nil {
+			return nil, err
+		}
+		if merged == nil {
+			merged = s
+			continue
+		}
+		if err := merged.Merge(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if merged == nil {
+		merged = newSketch(defaultSketchAccuracy)
+	}
+	return merged, nil
+}
+
+// Service and connect time sketches for router requests
+type routerSketchState struct {
+	service *sketch
+	connect *sketch
+}
+
+func newRouterSketchState() rollup {
+	return &routerSketchState{
+		service: newSketch(defaultSketchAccuracy),
+		connect: newSketch(defaultSketchAccuracy),
+	}
+}
+
+func (r *routerSketchState) add(p point) {
+	service, _ := p.Points[2].(int)
+	connect, _ := p.Points[3].(int)
+	n := uint64(roundCount(sampleWeight(p)))
+	r.service.AddN(float64(service), n)
+	r.connect.AddN(float64(connect), n)
+}
+
+func (r *routerSketchState) points(token string, ts int64) []point {
+	return []point{{
+		Token:  token,
+		Type:   routerSketch,
+		Points: []interface{}{ts, r.service.Count(), r.service.String(), r.connect.String()},
+	}}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+)
+
+func assertWithinAccuracy(t *testing.T, q, expected, actual float64) {
+	if math.Abs(actual-expected) > expected*defaultSketchAccuracy {
+		t.Errorf("q=%g: expected %g within %g, got %g", q, expected, defaultSketchAccuracy, actual)
+	}
+}
+
+func TestSketchQuantiles(t *testing.T) {
+	s := newSketch(defaultSketchAccuracy)
+	for i := 1; i <= 1000; i++ {
+		s.Add(float64(i))
+	}
+
+	for _, q := range []float64{0.5, 0.95, 0.99} {
+		assertWithinAccuracy(t, q, q*999+1, s.Quantile(q))
+	}
+}
+
+func TestSketchRoundTrip(t *testing.T) {
+	s := newSketch(defaultSketchAccuracy)
+	for _, v := range []float64{0, 0, 1, 3, 40, 1500, 30000} {
+		s.Add(v)
+	}
+
+	parsed, err := parseSketch(s.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Count() != s.Count() {
+		t.Errorf("Expected count %d, got %d", s.Count(), parsed.Count())
+	}
+	for _, q := range []float64{0, 0.25, 0.5, 0.9, 1} {
+		if parsed.Quantile(q) != s.Quantile(q) {
+			t.Errorf("q=%g: expected %g, got %g", q, s.Quantile(q), parsed.Quantile(q))
+		}
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	low := newSketch(defaultSketchAccuracy)
+	high := newSketch(defaultSketchAccuracy)
+	for i := 1; i <= 500; i++ {
+		low.Add(float64(i))
+		high.Add(float64(i + 500))
+	}
+
+	merged, err := mergeSketches([]string{low.String(), high.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged.Count() != 1000 {
+		t.Errorf("Expected 1000 values, got %d", merged.Count())
+	}
+	assertWithinAccuracy(t, 0.99, 0.99*999+1, merged.Quantile(0.99))
+
+	if err := merged.Merge(newSketch(0.05)); err != errSketchAccuracy {
+		t.Errorf("Expected an accuracy mismatch error, got %v", err)
+	}
+}
+
+func TestServeSketchMerge(t *testing.T) {
+	a := newSketch(defaultSketchAccuracy)
+	b := newSketch(defaultSketchAccuracy)
+	a.Add(100)
+	b.Add(200)
+
+	body, _ := json.Marshal(sketchMergeRequest{Sketches: []string{a.String(), b.String()}, Quantiles: []float64{1}})
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, newRoutes(newTestClientFunc))
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/sketch/merge", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.http.Handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatal("Wrong Response Code: ", recorder.Code)
+	}
+
+	var resp sketchMergeResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != 2 {
+		t.Errorf("Expected 2 values, got %d", resp.Count)
+	}
+	assertWithinAccuracy(t, 1, 200, resp.Quantiles["1"])
+}
+
+func TestSketchMergeRejectsOutOfRange(t *testing.T) {
+	a := newSketch(defaultSketchAccuracy)
+	a.Add(100)
+
+	body, _ := json.Marshal(sketchMergeRequest{Sketches: []string{a.String()}, Quantiles: []float64{0.5, 1.5}})
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, newRoutes(newTestClientFunc))
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/sketch/merge", bytes.NewReader(body))
+	server.http.Handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a quantile above 1 to be a bad request, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/sketch/merge", bytes.NewReader(make([]byte, maxSketchMergeBytes+1)))
+	server.http.Handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an oversized body to be rejected, got %d", recorder.Code)
+	}
+
+	if err := sketchCommand([]string{"merge", "-q", "0.5,-0.1", a.String()}, nil, ioutil.Discard); err == nil {
+		t.Error("Expected a negative quantile to be an error")
+	}
+
+	if _, err := parseSketch(newSketch(1).String()); err != errSketchRange {
+		t.Errorf("Expected an accuracy of 1 to be rejected, got %v", err)
+	}
+}
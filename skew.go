@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+// What to do with a point whose timestamp is outside of the skew window
+type skewAction int
+
+const (
+	skewMeasure skewAction = iota // Only record the skew
+	skewClamp                     // Move the timestamp to the edge of the window
+	skewDrop                      // Discard the point
+	skewTag                       // Write the point to a "skewed." series
+)
+
+const (
+	defaultSkewMaxPast   = time.Hour
+	defaultSkewMaxFuture = 5 * time.Minute
+)
+
+var (
+	skewHistogram      = metrics.GetOrRegisterHistogram("lumbermill.skew", metrics.DefaultRegistry, metrics.NewUniformSample(100))
+	skewClampedCounter = metrics.GetOrRegisterCounter("lumbermill.skew.clamped", metrics.DefaultRegistry)
+	skewDroppedCounter = metrics.GetOrRegisterCounter("lumbermill.skew.dropped", metrics.DefaultRegistry)
+	skewTaggedCounter  = metrics.GetOrRegisterCounter("lumbermill.skew.tagged", metrics.DefaultRegistry)
+)
+
+// Measures the difference between a point's timestamp and the time it was
+// received, and decides what happens to points outside of [maxPast, maxFuture].
+type skewPolicy struct {
+	action    skewAction
+	maxPast   time.Duration
+	maxFuture time.Duration
+}
+
+func newSkewPolicy(action skewAction, maxPast, maxFuture time.Duration) *skewPolicy {
+	return &skewPolicy{action: action, maxPast: maxPast, maxFuture: maxFuture}
+}
+
+// Configures a skew policy from SKEW_POLICY (clamp, drop or tag),
+// SKEW_MAX_PAST and SKEW_MAX_FUTURE. An unset SKEW_POLICY only measures.
+func newSkewPolicyFromEnv() *skewPolicy {
+	action := skewMeasure
+	switch v := os.Getenv("SKEW_POLICY"); v {
+	case "":
+	case "clamp":
+		action = skewClamp
+	case "drop":
+		action = skewDrop
+	case "tag":
+		action = skewTag
+	default:
+		logger.Warn("skew", "err", "unknown skew policy, only measuring", "policy", v)
+	}
+
+	return newSkewPolicy(action,
+		envDuration("SKEW_MAX_PAST", defaultSkewMaxPast),
+		envDuration("SKEW_MAX_FUTURE", defaultSkewMaxFuture),
+	)
+}
+
+// Records the skew of the point and applies the policy to it. Returns false
+// if the point should be dropped.
+func (sp *skewPolicy) apply(p *point, received time.Time) bool {
+	ts, ok := p.Points[0].(int64)
+	if !ok {
+		return true
+	}
+
+	recv := received.UnixNano() / int64(time.Microsecond)
+	skew := ts - recv
+
+	// Skew is recorded in milliseconds, positive for points from the future.
+	// It isn't broken down by token, which would register a histogram for
+	// every token ever seen.
+	skewHistogram.Update(skew / 1000)
+
+	maxFuture := int64(sp.maxFuture / time.Microsecond)
+	maxPast := int64(sp.maxPast / time.Microsecond)
+	if skew <= maxFuture && -skew <= maxPast {
+		return true
+	}
+
+	switch sp.action {
+	case skewClamp:
+		skewClampedCounter.Inc(1)
+		if skew > 0 {
+			p.Points[0] = recv + maxFuture
+		} else {
+			p.Points[0] = recv - maxPast
+		}
+	case skewDrop:
+		skewDroppedCounter.Inc(1)
+		return false
+	case skewTag:
+		skewTaggedCounter.Inc(1)
+		p.Skewed = true
+	}
+
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+func newSkewTestPoint(ts time.Time) point {
+	return point{Token: "foo", Type: routerRequest, Points: []interface{}{ts.UnixNano() / int64(time.Microsecond), 200, 10}}
+}
+
+func TestSkewPolicyWithinWindow(t *testing.T) {
+	received := time.Now()
+	for _, action := range []skewAction{skewMeasure, skewClamp, skewDrop, skewTag} {
+		sp := newSkewPolicy(action, time.Hour, time.Minute)
+		p := newSkewTestPoint(received.Add(-30 * time.Minute))
+		before := p.Points[0]
+
+		if !sp.apply(&p, received) {
+			t.Errorf("action=%d: point within window was dropped", action)
+		}
+		if p.Points[0] != before || p.Skewed {
+			t.Errorf("action=%d: point within window was modified", action)
+		}
+	}
+
+	if metrics.DefaultRegistry.Get("lumbermill.skew.foo") != nil {
+		t.Error("Expected skew not to be recorded per token")
+	}
+}
+
+func TestSkewPolicyClamp(t *testing.T) {
+	received := time.Now()
+	recv := received.UnixNano() / int64(time.Microsecond)
+	sp := newSkewPolicy(skewClamp, time.Hour, time.Minute)
+
+	future := newSkewTestPoint(received.Add(time.Hour))
+	if !sp.apply(&future, received) {
+		t.Fatal("clamped point was dropped")
+	}
+	if future.Points[0] != recv+int64(time.Minute/time.Microsecond) {
+		t.Errorf("future point not clamped to window: %v", future.Points[0])
+	}
+
+	past := newSkewTestPoint(received.Add(-2 * time.Hour))
+	if !sp.apply(&past, received) {
+		t.Fatal("clamped point was dropped")
+	}
+	if past.Points[0] != recv-int64(time.Hour/time.Microsecond) {
+		t.Errorf("past point not clamped to window: %v", past.Points[0])
+	}
+}
+
+func TestSkewPolicyDrop(t *testing.T) {
+	received := time.Now()
+	sp := newSkewPolicy(skewDrop, time.Hour, time.Minute)
+
+	p := newSkewTestPoint(received.Add(10 * time.Minute))
+	if sp.apply(&p, received) {
+		t.Error("future point was not dropped")
+	}
+}
+
+func TestSkewPolicyTag(t *testing.T) {
+	received := time.Now()
+	sp := newSkewPolicy(skewTag, time.Hour, time.Minute)
+
+	p := newSkewTestPoint(received.Add(-3 * time.Hour))
+	if !sp.apply(&p, received) {
+		t.Fatal("tagged point was dropped")
+	}
+	if !p.Skewed {
+		t.Error("point was not tagged")
+	}
+	if p.SeriesName() != "skewed.router.foo" {
+		t.Errorf("wrong series name for tagged point: %s", p.SeriesName())
+	}
+}
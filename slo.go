@@ -0,0 +1,216 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultApdexT    = 500 * time.Millisecond
+	defaultSLOTarget = 0.999
+)
+
+var defaultBurnWindows = []time.Duration{5 * time.Minute, time.Hour, 6 * time.Hour}
+
+// Configuration for, and history of, per token SLO computation
+type sloTracker struct {
+	sync.Mutex
+	apdexT       int // Milliseconds
+	apdexTTokens map[string]int
+	target       float64
+	windows      []time.Duration
+	maxWindow    int64 // Microseconds
+	history      map[string][]sloSample
+	lastPrune    int64
+}
+
+// Request and error counts for one token over one interval
+type sloSample struct {
+	bucket   int64
+	requests float64 // Weighted by sample rate
+	errors   float64
+}
+
+func newSLOTracker(apdexT time.Duration, apdexTTokens map[string]time.Duration, target float64, windows []time.Duration) *sloTracker {
+	t := &sloTracker{
+		apdexT:       int(apdexT / time.Millisecond),
+		apdexTTokens: make(map[string]int),
+		target:       target,
+		windows:      windows,
+		history:      make(map[string][]sloSample),
+	}
+	for token, d := range apdexTTokens {
+		t.apdexTTokens[token] = int(d / time.Millisecond)
+	}
+	for _, w := range windows {
+		if us := int64(w / time.Microsecond); us > t.maxWindow {
+			t.maxWindow = us
+		}
+	}
+	return t
+}
+
+// Configures an SLO tracker from APDEX_T, APDEX_T_TOKENS
+// ("token1:200ms|token2:1s"), SLO_TARGET and SLO_BURN_WINDOWS ("5m,1h,6h").
+func newSLOTrackerFromEnv() *sloTracker {
+	tokens := make(map[string]time.Duration)
+	for token, v := range parseKeyValueList(os.Getenv("APDEX_T_TOKENS")) {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			logger.Warn("slo", "err", err, "token", token, "apdex_t", v)
+			continue
+		}
+		tokens[token] = d
+	}
+
+	windows := defaultBurnWindows
+	if v := os.Getenv("SLO_BURN_WINDOWS"); v != "" {
+		windows = nil
+		for _, w := range strings.Split(v, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(w))
+			if err != nil {
+				logger.Warn("slo", "err", err, "window", w)
+				continue
+			}
+			windows = append(windows, d)
+		}
+	}
+
+	// Burn rates are relative to the error budget, 1-target, so a target of 1
+	// or more would make them infinite.
+	target := envFloat("SLO_TARGET", defaultSLOTarget)
+	if target <= 0 || target >= 1 {
+		logger.Warn("slo", "err", "SLO_TARGET must be between 0 and 1", "target", target)
+		target = defaultSLOTarget
+	}
+
+	return newSLOTracker(envDuration("APDEX_T", defaultApdexT), tokens, target, windows)
+}
+
+func (t *sloTracker) apdexTFor(token string) int {
+	if apdexT, ok := t.apdexTTokens[token]; ok {
+		return apdexT
+	}
+	return t.apdexT
+}
+
+func (t *sloTracker) newRollup() rollup {
+	return &sloRollupState{tracker: t}
+}
+
+// Records a finished interval and returns the error rate and burn rate over
+// each window ending with it.
+func (t *sloTracker) record(token string, sample sloSample) (errorRates, burnRates []float64) {
+	t.Lock()
+	defer t.Unlock()
+
+	history := append(t.history[token], sample)
+	kept := history[:0]
+	for _, s := range history {
+		if s.bucket > sample.bucket-t.maxWindow {
+			kept = append(kept, s)
+		}
+	}
+	t.history[token] = kept
+
+	// Forget tokens that haven't been seen for the longest window.
+	if sample.bucket-t.lastPrune > t.maxWindow {
+		for tok, h := range t.history {
+			if len(h) == 0 || h[len(h)-1].bucket <= sample.bucket-t.maxWindow {
+				delete(t.history, tok)
+			}
+		}
+		t.lastPrune = sample.bucket
+	}
+
+	for _, w := range t.windows {
+		start := sample.bucket - int64(w/time.Microsecond)
+		requests, errors := 0.0, 0.0
+		for _, s := range kept {
+			if s.bucket > start && s.bucket <= sample.bucket {
+				requests += s.requests
+				errors += s.errors
+			}
+		}
+
+		errorRate := 0.0
+		if requests > 0 {
+			errorRate = errors / requests
+		}
+		errorRates = append(errorRates, errorRate)
+		burnRates = append(burnRates, finite(errorRate/(1-t.target)))
+	}
+
+	return errorRates, burnRates
+}
+
+// Apdex and availability for one token over one interval. Router H errors and
+// 5xx responses are both failed requests, and frustrated for Apdex. Sampled
+// requests are weighted by the inverse of their sample rate.
+type sloRollupState struct {
+	tracker    *sloTracker
+	apdexT     int
+	requests   float64
+	errors     float64
+	satisfied  float64
+	tolerating float64
+}
+
+func (r *sloRollupState) add(p point) {
+	if r.requests == 0 {
+		r.apdexT = r.tracker.apdexTFor(p.Token)
+	}
+
+	weight := sampleWeight(p)
+	r.requests += weight
+
+	switch p.Type {
+	case routerEvent:
+		r.errors += weight
+	case routerRequest:
+		status, _ := p.Points[1].(int)
+		service, _ := p.Points[2].(int)
+		switch {
+		case status >= 500:
+			r.errors += weight
+		case service <= r.apdexT:
+			r.satisfied += weight
+		case service <= 4*r.apdexT:
+			r.tolerating += weight
+		}
+	}
+}
+
+func (r *sloRollupState) points(token string, ts int64) []point {
+	apdex := finite((r.satisfied + r.tolerating/2) / r.requests)
+	availability := finite(1 - r.errors/r.requests)
+
+	points := []point{{
+		Token:  token,
+		Type:   sloSeries,
+		Points: []interface{}{ts, roundCount(r.requests), roundCount(r.errors), r.apdexT, apdex, availability},
+	}}
+
+	errorRates, burnRates := r.tracker.record(token, sloSample{bucket: ts, requests: r.requests, errors: r.errors})
+	for i, w := range r.tracker.windows {
+		points = append(points, point{
+			Token:  token,
+			Type:   sloBurnSeries,
+			Points: []interface{}{ts, w.String(), errorRates[i], burnRates[i]},
+		})
+	}
+
+	return points
+}
+
+// Replaces NaN and infinities, which can't be encoded as JSON and would fail
+// the whole write they're in, with 0.
+func finite(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
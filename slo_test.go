@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSLOApdexAndAvailability(t *testing.T) {
+	tracker := newSLOTracker(100*time.Millisecond, map[string]time.Duration{"slow": time.Second}, 0.99, []time.Duration{time.Minute})
+	agg := newAggregator(newRollupStage(time.Minute, false, tracker.newRollup, routerRequest, routerEvent))
+
+	ts := int64(1404259200000000)
+	for _, token := range []string{"fast", "slow"} {
+		agg.Add(point{Token: token, Type: routerRequest, Points: []interface{}{ts, 200, 50, 1}})  // satisfied
+		agg.Add(point{Token: token, Type: routerRequest, Points: []interface{}{ts, 200, 300, 1}}) // tolerating for fast
+		agg.Add(point{Token: token, Type: routerRequest, Points: []interface{}{ts, 503, 50, 1}})  // error
+		agg.Add(point{Token: token, Type: routerEvent, Points: []interface{}{ts, "H12"}})         // error
+	}
+
+	slos := make(map[string]point)
+	for _, p := range agg.Flush() {
+		if p.Type == sloSeries {
+			slos[p.Token] = p
+		}
+	}
+
+	expected := map[string][]interface{}{
+		"fast": {ts, 4, 2, 100, 0.375, 0.5},
+		"slow": {ts, 4, 2, 1000, 0.5, 0.5},
+	}
+
+	for token, columns := range expected {
+		p, ok := slos[token]
+		if !ok {
+			t.Fatalf("No slo point for %s", token)
+		}
+		for i, v := range columns {
+			if p.Points[i] != v {
+				t.Errorf("token=%s column=%s: expected %v, got %v", token, seriesColumns[sloSeries][i], v, p.Points[i])
+			}
+		}
+	}
+}
+
+func TestSLOBurnRate(t *testing.T) {
+	tracker := newSLOTracker(defaultApdexT, nil, 0.99, []time.Duration{time.Minute, 3 * time.Minute})
+	interval := int64(time.Minute / time.Microsecond)
+	ts := int64(1404259200000000)
+
+	// 1% errors for two intervals, then 10%.
+	tracker.record("foo", sloSample{bucket: ts, requests: 100, errors: 1})
+	tracker.record("foo", sloSample{bucket: ts + interval, requests: 100, errors: 1})
+	errorRates, burnRates := tracker.record("foo", sloSample{bucket: ts + 2*interval, requests: 100, errors: 10})
+
+	expectedErrorRates := []float64{0.1, 0.04}
+	expectedBurnRates := []float64{10, 4}
+	for i := range expectedErrorRates {
+		if math.Abs(errorRates[i]-expectedErrorRates[i]) > 1e-9 {
+			t.Errorf("window=%s: expected error rate %g, got %g", tracker.windows[i], expectedErrorRates[i], errorRates[i])
+		}
+		if math.Abs(burnRates[i]-expectedBurnRates[i]) > 1e-9 {
+			t.Errorf("window=%s: expected burn rate %g, got %g", tracker.windows[i], expectedBurnRates[i], burnRates[i])
+		}
+	}
+}
+
+func TestSLOTargetFromEnv(t *testing.T) {
+	for _, target := range []string{"1", "1.5", "0", "-0.1"} {
+		os.Setenv("SLO_TARGET", target)
+		if tracker := newSLOTrackerFromEnv(); tracker.target != defaultSLOTarget {
+			t.Errorf("SLO_TARGET=%s: expected the default target, got %g", target, tracker.target)
+		}
+	}
+	os.Unsetenv("SLO_TARGET")
+
+	// Burn rates are always finite, so they can be written.
+	tracker := newSLOTracker(defaultApdexT, nil, 1, []time.Duration{time.Minute})
+	if _, burnRates := tracker.record("foo", sloSample{bucket: 1, requests: 100, errors: 1}); burnRates[0] != 0 {
+		t.Errorf("Expected a finite burn rate, got %g", burnRates[0])
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	influx "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/influxdb/influxdb-go"
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+const (
+	defaultSpoolSegmentBytes = 16 << 20
+	defaultSpoolMaxBytes     = 1 << 30
+	spoolOverflowPoints      = 5000
+	spoolReplayInterval      = time.Second
+	spoolMaxReplayBackoff    = time.Minute
+	spoolSegmentSuffix       = ".seg"
+	spoolPositionSuffix      = ".pos"
+	spoolRecordHeaderBytes   = 8
+)
+
+var (
+	errSpoolCorrupt  = errors.New("corrupt spool record")
+	errSpoolDeadline = errors.New("spool replay deadline passed")
+)
+
+// A write-ahead spool of batches on local disk for one destination.
+//
+// Batches that fail to deliver, and points that don't fit in the destination's
+// channel, are appended to segment files. Segments are replayed oldest first
+// when the backend accepts writes again. Each record is a length, a CRC32 of
+// the payload and a JSON payload of series.
+type spool struct {
+	sync.Mutex
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+	write        func([]*influx.Series) error
+
+	segments []int64 // Sequence numbers, oldest first. The last is open for writing.
+	active   *os.File
+	size     int64         // Bytes across all segments
+	points   map[int64]int // Points not yet replayed, by segment
+
+	overflow      map[string]*influx.Series
+	overflowCount int
+
+	closed     chan struct{}
+	replayLock sync.Mutex // Held while replaying, so Flush and Run don't replay the same segment
+
+	depthBytesGauge    metrics.Gauge
+	depthSegmentsGauge metrics.Gauge
+	appendedCounter    metrics.Counter
+	droppedCounter     metrics.Counter
+	corruptCounter     metrics.Counter
+	rejectedCounter    metrics.Counter
+	replayedMeter      metrics.Meter
+}
+
+// Opens, or creates, the spool in dir. Existing segments are queued for
+// replay.
+func newSpool(dir, name string, segmentBytes, maxBytes int64, write func([]*influx.Series) error) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:                dir,
+		segmentBytes:       segmentBytes,
+		maxBytes:           maxBytes,
+		write:              write,
+		points:             make(map[int64]int),
+		overflow:           make(map[string]*influx.Series),
+		closed:             make(chan struct{}),
+		depthBytesGauge:    metrics.GetOrRegisterGauge("lumbermill.spool.depth.bytes."+name, metrics.DefaultRegistry),
+		depthSegmentsGauge: metrics.GetOrRegisterGauge("lumbermill.spool.depth.segments."+name, metrics.DefaultRegistry),
+		appendedCounter:    metrics.GetOrRegisterCounter("lumbermill.spool.appended.points."+name, metrics.DefaultRegistry),
+		droppedCounter:     metrics.GetOrRegisterCounter("lumbermill.spool.dropped.points."+name, metrics.DefaultRegistry),
+		corruptCounter:     metrics.GetOrRegisterCounter("lumbermill.spool.corrupt."+name, metrics.DefaultRegistry),
+		rejectedCounter:    metrics.GetOrRegisterCounter("lumbermill.spool.rejected.points."+name, metrics.DefaultRegistry),
+		replayedMeter:      metrics.GetOrRegisterMeter("lumbermill.spool.replayed.points."+name, metrics.DefaultRegistry),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), spoolSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+		s.size += f.Size()
+		if points, err := countSegmentPoints(s.segmentPath(seq)); err == nil {
+			s.points[seq] = points
+		}
+	}
+	sort.Sort(int64s(s.segments))
+
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Creates the spool for a destination if SPOOL_DIR is set, sized by
+// SPOOL_SEGMENT_BYTES and SPOOL_MAX_BYTES. Returns nil otherwise.
+func newSpoolFromEnv(name string, write func([]*influx.Series) error) *spool {
+	root := os.Getenv("SPOOL_DIR")
+	if root == "" {
+		return nil
+	}
+
+	s, err := newSpool(
+		filepath.Join(root, spoolDirName(name)),
+		name,
+		int64(envInt("SPOOL_SEGMENT_BYTES", defaultSpoolSegmentBytes)),
+		int64(envInt("SPOOL_MAX_BYTES", defaultSpoolMaxBytes)),
+		write,
+	)
+	if err != nil {
+		logger.Error("spool", "destination", name, "err", err)
+		return nil
+	}
+	return s
+}
+
+// host:port isn't a great directory name everywhere
+func spoolDirName(name string) string {
+	return strings.NewReplacer(":", "_", "/", "_").Replace(name)
+}
+
+func (s *spool) segmentPath(seq int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentSuffix))
+}
+
+// Closes the active segment and opens a new one. Must be called with the lock
+// held.
+func (s *spool) rotate() error {
+	if s.active != nil {
+		s.active.Close()
+	}
+
+	seq := int64(0)
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1] + 1
+	}
+
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.active = nil
+		return err
+	}
+	s.active = f
+	s.segments = append(s.segments, seq)
+	s.updateGauges()
+	return nil
+}
+
+func (s *spool) updateGauges() {
+	s.depthBytesGauge.Update(s.size)
+	s.depthSegmentsGauge.Update(int64(len(s.segments)))
+}
+
+// Appends a batch to the spool.
+func (s *spool) Append(series []*influx.Series) error {
+	if s == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(series)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, spoolRecordHeaderBytes+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[spoolRecordHeaderBytes:], payload)
+
+	points := countPoints(series)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.active == nil {
+		if err := s.rotate(); err != nil {
+			s.droppedCounter.Inc(int64(points))
+			return err
+		}
+	}
+
+	if _, err := s.active.Write(record); err != nil {
+		s.droppedCounter.Inc(int64(points))
+		return err
+	}
+	s.size += int64(len(record))
+	s.points[s.segments[len(s.segments)-1]] += points
+	s.appendedCounter.Inc(int64(points))
+
+	if info, err := s.active.Stat(); err == nil && info.Size() >= s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			logger.Error("spool", "dir", s.dir, "err", err)
+		}
+	}
+
+	s.enforceMaxBytes()
+	s.updateGauges()
+	return nil
+}
+
+// Buffers a point that didn't fit in the destination's channel, appending the
+// buffer to the spool once it's big enough.
+func (s *spool) AppendPoint(p point) {
+	s.Lock()
+	addToDelivery(s.overflow, p)
+	s.overflowCount++
+	full := s.overflowCount >= spoolOverflowPoints
+	s.Unlock()
+
+	if full {
+		s.FlushOverflow()
+	}
+}
+
+// Appends any buffered overflow points to the spool.
+func (s *spool) FlushOverflow() {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	overflow := s.overflow
+	s.overflow = make(map[string]*influx.Series)
+	s.overflowCount = 0
+	s.Unlock()
+
+	if len(overflow) == 0 {
+		return
+	}
+
+	series := make([]*influx.Series, 0, len(overflow))
+	for _, ser := range overflow {
+		series = append(series, ser)
+	}
+	if err := s.Append(series); err != nil {
+		logger.Error("spool", "dir", s.dir, "err", err)
+	}
+}
+
+// Drops the oldest segments until the spool fits in maxBytes. Must be called
+// with the lock held.
+func (s *spool) enforceMaxBytes() {
+	for s.size > s.maxBytes && len(s.segments) > 1 {
+		seq := s.segments[0]
+		path := s.segmentPath(seq)
+		if info, err := os.Stat(path); err == nil {
+			s.size -= info.Size()
+		}
+		s.droppedCounter.Inc(int64(s.points[seq]))
+		delete(s.points, seq)
+		os.Remove(path)
+		os.Remove(path + spoolPositionSuffix)
+		s.segments = s.segments[1:]
+		logger.Warn("spool", "msg", "dropped segment over size cap", "dir", s.dir, "segment", seq)
+	}
+}
+
+// Returns the oldest segment ready for replay, rotating the active segment if
+// it's the only one with data.
+func (s *spool) nextSegment() (int64, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.segments) == 1 && s.size > 0 {
+		if err := s.rotate(); err != nil {
+			logger.Error("spool", "dir", s.dir, "err", err)
+			return 0, false
+		}
+	}
+	if len(s.segments) < 2 {
+		return 0, false
+	}
+	return s.segments[0], true
+}
+
+// Replays spooled batches in order until the spool is closed, backing off
+// while the backend is failing, and waiting while its destination is paused.
+func (s *spool) Run(waitWhilePaused func(stop <-chan struct{})) {
+	backoff := spoolReplayInterval
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-timer.C:
+		}
+
+		waitWhilePaused(s.closed)
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+
+		s.FlushOverflow()
+
+		if err := s.replay(); err != nil {
+			logger.Warn("spool-replay", "dir", s.dir, "err", err, "backoff", backoff)
+			backoff *= 2
+			if backoff > spoolMaxReplayBackoff {
+				backoff = spoolMaxReplayBackoff
+			}
+		} else {
+			backoff = spoolReplayInterval
+		}
+		timer.Reset(backoff)
+	}
+}
+
+// Replays finished segments until there are none left or a write fails.
+func (s *spool) replay() error {
+	return s.replayUntil(time.Time{})
+}
+
+// Replays finished segments until there are none left, a write fails with a
+// retryable error or, if it isn't zero, the deadline passes.
+func (s *spool) replayUntil(deadline time.Time) error {
+	s.replayLock.Lock()
+	defer s.replayLock.Unlock()
+
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return errSpoolDeadline
+		}
+		seq, ok := s.nextSegment()
+		if !ok {
+			return nil
+		}
+		if err := s.replaySegment(seq); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *spool) replaySegment(seq int64) error {
+	path := s.segmentPath(seq)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Skip records replayed before a failure or restart.
+	pos := readSpoolPosition(path)
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		payload, n, err := readSpoolRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.corruptCounter.Inc(1)
+			logger.Error("spool-replay", "segment", path, "offset", pos, "err", err, "msg", "skipping rest of segment")
+			break
+		}
+
+		var series []*influx.Series
+		if err := json.Unmarshal(payload, &series); err != nil {
+			s.corruptCounter.Inc(1)
+			logger.Error("spool-replay", "segment", path, "offset", pos, "err", err, "msg", "skipping record")
+		} else if err := s.write(series); err != nil {
+			// Batches InfluxDB rejects outright would block replay forever.
+			class := classifyWriteError(err)
+			if class == writeRetryable {
+				return err
+			}
+			s.rejectedCounter.Inc(int64(countPoints(series)))
+			logger.Error("spool-replay", "segment", path, "offset", pos, "err", err, "class", class.Name(), "msg", "skipping record")
+		} else {
+			s.replayedMeter.Mark(int64(countPoints(series)))
+		}
+
+		pos += n
+		writeSpoolPosition(path, pos)
+
+		s.Lock()
+		if s.points[seq] -= countPoints(series); s.points[seq] < 0 {
+			s.points[seq] = 0
+		}
+		s.Unlock()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// The segment may have been dropped for size while it was replayed.
+	if len(s.segments) > 0 && s.segments[0] == seq {
+		if info, err := f.Stat(); err == nil {
+			s.size -= info.Size()
+		}
+		os.Remove(path)
+		os.Remove(path + spoolPositionSuffix)
+		delete(s.points, seq)
+		s.segments = s.segments[1:]
+		s.updateGauges()
+	}
+	return nil
+}
+
+// Appends buffered overflow points, then replays everything spooled until
+// the spool is empty, a write fails or the deadline passes. Used on shutdown;
+// whatever is left is kept on disk for the next start.
+func (s *spool) Flush(deadline time.Time) error {
+	if s == nil {
+		return nil
+	}
+
+	s.FlushOverflow()
+	return s.replayUntil(deadline)
+}
+
+// The number of points spooled and not yet replayed.
+func (s *spool) Pending() int {
+	if s == nil {
+		return 0
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	points := s.overflowCount
+	for _, n := range s.points {
+		points += n
+	}
+	return points
+}
+
+// Flushes buffered overflow points and stops replaying. Spooled batches are
+// kept on disk for the next start.
+func (s *spool) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	close(s.closed)
+	s.FlushOverflow()
+
+	s.Lock()
+	defer s.Unlock()
+	if s.active != nil {
+		s.active.Sync()
+		return s.active.Close()
+	}
+	return nil
+}
+
+// Reads a record, returning its payload and size on disk.
+func readSpoolRecord(r io.Reader) ([]byte, int64, error) {
+	header := make([]byte, spoolRecordHeaderBytes)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errSpoolCorrupt
+		}
+		return nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, errSpoolCorrupt
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errSpoolCorrupt
+	}
+
+	return payload, int64(spoolRecordHeaderBytes + length), nil
+}
+
+func readSpoolPosition(segmentPath string) int64 {
+	data, err := ioutil.ReadFile(segmentPath + spoolPositionSuffix)
+	if err != nil {
+		return 0
+	}
+	pos, _ := strconv.ParseInt(string(data), 10, 64)
+	return pos
+}
+
+func writeSpoolPosition(segmentPath string, pos int64) {
+	if err := ioutil.WriteFile(segmentPath+spoolPositionSuffix, []byte(strconv.FormatInt(pos, 10)), 0644); err != nil {
+		logger.Error("spool", "segment", segmentPath, "err", err)
+	}
+}
+
+// Counts the points in a segment that haven't been replayed yet.
+func countSegmentPoints(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(readSpoolPosition(path), io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	points := 0
+	r := bufio.NewReader(f)
+	for {
+		payload, _, err := readSpoolRecord(r)
+		if err != nil {
+			break
+		}
+		var series []*influx.Series
+		if json.Unmarshal(payload, &series) == nil {
+			points += countPoints(series)
+		}
+	}
+	return points, nil
+}
+
+func countPoints(series []*influx.Series) int {
+	points := 0
+	for _, s := range series {
+		points += len(s.Points)
+	}
+	return points
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
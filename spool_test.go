@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	influx "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/influxdb/influxdb-go"
+)
+
+type spoolTestWriter struct {
+	fail     bool
+	rejected map[string]bool // Series names InfluxDB rejects with a 400
+	written  [][]*influx.Series
+}
+
+func (w *spoolTestWriter) write(series []*influx.Series) error {
+	if w.fail {
+		return errors.New("Server returned (503): backend down")
+	}
+	if w.rejected[series[0].Name] {
+		return errors.New("Server returned (400): bad series")
+	}
+	w.written = append(w.written, series)
+	return nil
+}
+
+func newTestSpool(t *testing.T, segmentBytes, maxBytes int64) (*spool, *spoolTestWriter, func()) {
+	dir, err := ioutil.TempDir("", "lumbermill-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := new(spoolTestWriter)
+	s, err := newSpool(dir, "test", segmentBytes, maxBytes, w.write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, w, func() { os.RemoveAll(dir) }
+}
+
+func testBatch(name string) []*influx.Series {
+	return []*influx.Series{{Name: name, Columns: []string{"time", "code"}, Points: [][]interface{}{{1, "H12"}}}}
+}
+
+func TestSpoolReplaysInOrder(t *testing.T) {
+	s, w, cleanup := newTestSpool(t, 64, 1<<20)
+	defer cleanup()
+
+	for _, name := range []string{"a", "b", "c"} {
+		if err := s.Append(testBatch(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w.fail = true
+	if err := s.replay(); err == nil {
+		t.Fatal("Expected replay to fail while the backend is down")
+	}
+	if len(w.written) != 0 {
+		t.Fatalf("Expected nothing written, got %d batches", len(w.written))
+	}
+
+	w.fail = false
+	if err := s.replay(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.written) != 3 {
+		t.Fatalf("Expected 3 batches replayed, got %d", len(w.written))
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		if w.written[i][0].Name != name {
+			t.Errorf("Batch %d: expected %s, got %s", i, name, w.written[i][0].Name)
+		}
+	}
+	if s.size != 0 {
+		t.Errorf("Expected an empty spool, have %d bytes", s.size)
+	}
+}
+
+func TestSpoolSurvivesRestart(t *testing.T) {
+	s, w, cleanup := newTestSpool(t, 1<<20, 1<<20)
+	defer cleanup()
+
+	s.Append(testBatch("a"))
+	s.Close()
+
+	reopened, err := newSpool(s.dir, "test", 1<<20, 1<<20, w.write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.written) != 1 || w.written[0][0].Name != "a" {
+		t.Errorf("Expected the spooled batch to be replayed after a restart, got %v", w.written)
+	}
+}
+
+func TestSpoolDetectsCorruption(t *testing.T) {
+	s, w, cleanup := newTestSpool(t, 1<<20, 1<<20)
+	defer cleanup()
+
+	s.Append(testBatch("a"))
+	s.Append(testBatch("b"))
+
+	// Flip a byte in the second record's payload.
+	path := s.segmentPath(s.segments[0])
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-3] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := s.corruptCounter.Count()
+	if err := s.replay(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.written) != 1 || w.written[0][0].Name != "a" {
+		t.Errorf("Expected only the intact batch to be replayed, got %v", w.written)
+	}
+	if s.corruptCounter.Count()-before != 1 {
+		t.Errorf("Expected one corrupt record, counted %d", s.corruptCounter.Count()-before)
+	}
+}
+
+func TestSpoolEnforcesMaxBytes(t *testing.T) {
+	s, w, cleanup := newTestSpool(t, 64, 256)
+	defer cleanup()
+
+	for i := 0; i < 20; i++ {
+		s.Append(testBatch("a"))
+	}
+
+	if s.size > 256 {
+		t.Errorf("Expected the spool to be capped at 256 bytes, have %d", s.size)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(s.dir, "*"+spoolSegmentSuffix))
+	if len(files) != len(s.segments) {
+		t.Errorf("Expected %d segment files, found %d", len(s.segments), len(files))
+	}
+
+	s.replay()
+	if len(w.written) == 0 || len(w.written) >= 20 {
+		t.Errorf("Expected some, but not all, batches to be replayed, got %d", len(w.written))
+	}
+}
+
+func TestDestinationSpoolsOverflow(t *testing.T) {
+	s, w, cleanup := newTestSpool(t, 1<<20, 1<<20)
+	defer cleanup()
+
+	d := newDestination("test", 1)
+	d.spool = s
+
+	d.PostPoint(point{Token: "foo", Type: routerEvent, Points: []interface{}{int64(1), "H12"}})
+	d.PostPoint(point{Token: "foo", Type: routerEvent, Points: []interface{}{int64(2), "H13"}})
+
+	s.FlushOverflow()
+	if err := s.replay(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.written) != 1 || len(w.written[0][0].Points) != 1 {
+		t.Fatalf("Expected the overflowing point to be spooled, got %v", w.written)
+	}
+	if w.written[0][0].Name != "events.router.foo" {
+		t.Errorf("Wrong series spooled: %s", w.written[0][0].Name)
+	}
+}
+
+func TestSpoolSkipsRejectedBatches(t *testing.T) {
+	s, w, cleanup := newTestSpool(t, 1<<20, 1<<20)
+	defer cleanup()
+
+	for _, name := range []string{"a", "bad", "c"} {
+		if err := s.Append(testBatch(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Pending() != 3 {
+		t.Fatalf("Expected 3 points pending, got %d", s.Pending())
+	}
+
+	w.rejected = map[string]bool{"bad": true}
+	before := s.rejectedCounter.Count()
+	if err := s.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.written) != 2 || w.written[1][0].Name != "c" {
+		t.Errorf("Expected replay to continue past the rejected batch, got %d batches", len(w.written))
+	}
+	if s.rejectedCounter.Count()-before != 1 {
+		t.Errorf("Expected the rejected point to be counted")
+	}
+	if s.Pending() != 0 {
+		t.Errorf("Expected nothing pending, got %d", s.Pending())
+	}
+}
+
+func TestSpoolHoldsReplayWhilePaused(t *testing.T) {
+	s, _, cleanup := newTestSpool(t, 1<<20, 1<<20)
+	defer cleanup()
+
+	d := newDestination("paused", 0)
+	d.Pause()
+	go s.Run(d.waitWhilePaused)
+	defer s.Close()
+
+	if err := s.Append(testBatch("a")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(spoolReplayInterval + 500*time.Millisecond)
+	if s.Pending() != 1 {
+		t.Fatalf("Expected the spool to hold its point while paused, have %d pending", s.Pending())
+	}
+
+	d.Resume()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Pending() != 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if s.Pending() != 0 {
+		t.Errorf("Expected the spool to replay once resumed, have %d pending", s.Pending())
+	}
+}
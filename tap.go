@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/bmizerany/lpx"
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+const (
+	defaultTapMaxConcurrent = 5
+	defaultTapMaxDuration   = 10 * time.Minute
+	tapBufferSize           = 1000
+	tapKeepalive            = 15 * time.Second
+)
+
+var (
+	errTooManyTaps = errors.New("too many taps are open")
+
+	tapsGauge          = metrics.GetOrRegisterGauge("lumbermill.tap.active", metrics.DefaultRegistry)
+	tapDroppedCounter  = metrics.GetOrRegisterCounter("lumbermill.tap.dropped", metrics.DefaultRegistry)
+	tapRejectedCounter = metrics.GetOrRegisterCounter("lumbermill.tap.rejected", metrics.DefaultRegistry)
+)
+
+// A raw line or a point, sent as a server-sent event
+type tapEvent struct {
+	name string
+	data []byte
+}
+
+type tapLine struct {
+	Time   string `json:"time"`
+	Name   string `json:"name"`
+	Procid string `json:"procid"`
+	Msg    string `json:"msg"`
+}
+
+type tapPoint struct {
+	Series      string        `json:"series"`
+	Columns     []string      `json:"columns"`
+	Values      []interface{} `json:"values"`
+	RateLimited bool          `json:"rate_limited,omitempty"`
+}
+
+// One client watching a token. Events are dropped, and counted, rather than
+// slowing down drains when the client can't keep up.
+type tap struct {
+	token   string
+	types   map[seriesType]bool // nil for every type
+	lines   bool
+	events  chan tapEvent
+	dropped int64
+}
+
+func (t *tap) send(name string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+
+	select {
+	case t.events <- tapEvent{name: name, data: data}:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+		tapDroppedCounter.Inc(1)
+	}
+}
+
+// The open taps, by token. Drains check active before taking the lock, so
+// there's next to no overhead while nothing is tapped.
+type tapHub struct {
+	sync.Mutex
+	active        int32
+	taps          map[string]map[*tap]bool
+	maxConcurrent int
+	maxDuration   time.Duration
+}
+
+func newTapHub(maxConcurrent int, maxDuration time.Duration) *tapHub {
+	return &tapHub{
+		taps:          make(map[string]map[*tap]bool),
+		maxConcurrent: maxConcurrent,
+		maxDuration:   maxDuration,
+	}
+}
+
+// Configures taps from TAP_MAX_CONCURRENT and TAP_MAX_DURATION.
+func newTapHubFromEnv() *tapHub {
+	return newTapHub(
+		envInt("TAP_MAX_CONCURRENT", defaultTapMaxConcurrent),
+		envDuration("TAP_MAX_DURATION", defaultTapMaxDuration),
+	)
+}
+
+func (h *tapHub) open(token string, types map[seriesType]bool, lines bool) (*tap, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if int(atomic.LoadInt32(&h.active)) >= h.maxConcurrent {
+		tapRejectedCounter.Inc(1)
+		return nil, errTooManyTaps
+	}
+
+	t := &tap{token: token, types: types, lines: lines, events: make(chan tapEvent, tapBufferSize)}
+	if h.taps[token] == nil {
+		h.taps[token] = make(map[*tap]bool)
+	}
+	h.taps[token][t] = true
+	tapsGauge.Update(int64(atomic.AddInt32(&h.active, 1)))
+	return t, nil
+}
+
+func (h *tapHub) close(t *tap) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.taps[t.token], t)
+	if len(h.taps[t.token]) == 0 {
+		delete(h.taps, t.token)
+	}
+	tapsGauge.Update(int64(atomic.AddInt32(&h.active, -1)))
+}
+
+// Calls f with each of the token's taps.
+func (h *tapHub) each(token string, f func(*tap)) {
+	if atomic.LoadInt32(&h.active) == 0 {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	for t := range h.taps[token] {
+		f(t)
+	}
+}
+
+// Sends a raw drain line to the token's taps.
+func (h *tapHub) Line(token string, header *lpx.Header, msg []byte) {
+	h.each(token, func(t *tap) {
+		if t.lines {
+			t.send("line", tapLine{
+				Time:   string(header.Time),
+				Name:   string(header.Name),
+				Procid: string(header.Procid),
+				Msg:    string(msg),
+			})
+		}
+	})
+}
+
+// Sends a point, about to be posted or rate limited, to the token's taps.
+func (h *tapHub) Point(p point, rateLimited bool) {
+	h.each(p.Token, func(t *tap) {
+		if t.types == nil || t.types[p.Type] {
+			t.send("point", tapPoint{
+				Series:      p.SeriesName(),
+				Columns:     p.Type.Columns(),
+				Values:      p.Points,
+				RateLimited: rateLimited,
+			})
+		}
+	})
+}
+
+// GET /tap/<token>[?types=router,events.router][&lines=false][&duration=1m]
+//
+// Streams the token's raw drain lines and the points parsed from them as
+// server-sent events, until the client disconnects or the duration, capped by
+// TAP_MAX_DURATION, passes.
+func (s *server) serveTap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		wrongMethodErrorCounter.Inc(1)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/tap/")
+	if token == "" || strings.Contains(token, "/") {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		badRequestCounter.Inc(1)
+		return
+	}
+
+	query := r.URL.Query()
+	var types map[seriesType]bool
+	if v := query.Get("types"); v != "" {
+		types = make(map[seriesType]bool)
+		for _, name := range strings.Split(v, ",") {
+			st, ok := seriesTypeByName(strings.TrimSpace(name))
+			if !ok {
+				http.Error(w, fmt.Sprintf("unknown series type %q", name), http.StatusBadRequest)
+				badRequestCounter.Inc(1)
+				return
+			}
+			types[st] = true
+		}
+	}
+
+	duration := s.taps.maxDuration
+	if v := query.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid duration %q", v), http.StatusBadRequest)
+			badRequestCounter.Inc(1)
+			return
+		}
+		if d < duration {
+			duration = d
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		internalServerErrorCounter.Inc(1)
+		return
+	}
+
+	t, err := s.taps.open(token, types, query.Get("lines") != "false")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer s.taps.close(t)
+	logger.Info("tap-open", "token", token, "duration", duration)
+
+	headers := w.Header()
+	headers.Set("Content-Type", "text/event-stream")
+	headers.Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, ": tapping %s\n\n", token)
+	flusher.Flush()
+
+	end := time.NewTimer(duration)
+	defer end.Stop()
+	keepalive := time.NewTicker(tapKeepalive)
+	defer keepalive.Stop()
+
+	var reported int64
+	var reason string
+	for reason == "" {
+		select {
+		case ev := <-t.events:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, ev.data)
+		case <-keepalive.C:
+			if dropped := atomic.LoadInt64(&t.dropped); dropped > reported {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped-reported)
+				reported = dropped
+			} else {
+				fmt.Fprint(w, ": keepalive\n\n")
+			}
+		case <-end.C:
+			reason = "duration"
+		case <-s.shuttingDown:
+			reason = "shutdown"
+		case <-r.Context().Done():
+			logger.Info("tap-close", "token", token, "reason", "client", "dropped", atomic.LoadInt64(&t.dropped))
+			return
+		}
+		flusher.Flush()
+	}
+
+	fmt.Fprintf(w, "event: end\ndata: {\"reason\":%q}\n\n", reason)
+	flusher.Flush()
+	logger.Info("tap-close", "token", token, "reason", reason, "dropped", atomic.LoadInt64(&t.dropped))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/bmizerany/lpx"
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+)
+
+func TestServeTap(t *testing.T) {
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, createMessageRoutes("null", newTestClientFunc))
+	server.taps = newTapHub(1, time.Minute)
+	testServer := httptest.NewServer(server.http.Handler)
+	defer testServer.Close()
+
+	resp, err := http.Get(testServer.URL + "/tap/t.abc?types=router&duration=2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	r := bufio.NewReader(resp.Body)
+	if line, _ := r.ReadString('\n'); line != ": tapping t.abc\n" {
+		t.Fatalf("Expected the tap to start, got %q", line)
+	}
+
+	// Only one tap is allowed at a time.
+	rejected, err := http.Get(testServer.URL + "/tap/t.def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected.Body.Close()
+	if rejected.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected a second tap to be rejected, got %d", rejected.StatusCode)
+	}
+
+	header := &lpx.Header{Time: []byte("2014-07-02T00:00:00+00:00"), Name: []byte("heroku"), Procid: []byte("router")}
+	server.taps.Line("t.abc", header, []byte("at=info status=200"))
+	server.taps.Point(point{Token: "t.abc", Type: routerEvent, Points: []interface{}{int64(1), "H12"}}, false)
+	server.taps.Point(point{Token: "t.other", Type: routerRequest, Points: []interface{}{int64(1), 200, 1, 1}}, false)
+	server.taps.Point(point{Token: "t.abc", Type: routerRequest, Points: []interface{}{int64(1), 200, 1, 1}}, true)
+
+	var events []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(line, "event: ") || strings.HasPrefix(line, "data: ") {
+			events = append(events, strings.TrimSpace(line))
+		}
+	}
+
+	expected := []string{
+		"event: line",
+		`data: {"time":"2014-07-02T00:00:00+00:00","name":"heroku","procid":"router","msg":"at=info status=200"}`,
+		"event: point",
+		`data: {"series":"router.t.abc","columns":["time","status","service","connect","sample_rate"],"values":[1,200,1,1],"rate_limited":true}`,
+		"event: end",
+		`data: {"reason":"duration"}`,
+	}
+	if strings.Join(events, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(events, "\n"))
+	}
+}
+
+func TestServeTapRejectsUnknownTypes(t *testing.T) {
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, createMessageRoutes("null", newTestClientFunc))
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/tap/t.abc?types=nope", nil)
+	server.http.Handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a 400, got %d", recorder.Code)
+	}
+}
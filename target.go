@@ -1,11 +1,99 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 )
 
+// The most tokens a single POST /target can look up
+const maxTargetTokens = 10000
+
+// Host and replicas come from the topology alone, so they only change with the
+// ring version.
+type targetResponse struct {
+	Host     string   `json:"host"`
+	Replicas []string `json:"replicas"`
+
+	// While replicas' circuit breakers are open, or they're overloaded, the
+	// hosts new points are written to instead. Unlike the replicas, this can
+	// change at any time.
+	Failover []string `json:"failover,omitempty"`
+
+	// During a ring transition, the replicas in the previous topology, which
+	// may hold the token's history.
+	Previous       []string   `json:"previous,omitempty"`
+	TransitionEnds *time.Time `json:"transition_ends,omitempty"`
+}
+
+type targetsRequest struct {
+	Tokens []string `json:"tokens"`
+}
+
+// Lookups are only valid for the ring version they were made with, so clients
+// can cache them until it changes.
+type targetsResponse struct {
+	Version  int                       `json:"version"`
+	Database string                    `json:"database"`
+	Targets  map[string]targetResponse `json:"targets"`
+	Health   map[string]string         `json:"health"` // By host
+}
+
+// Looks up the token's replicas in the ring, any hosts they're failing over
+// to and, during a transition, the replicas in the previous ring. Returns false if the ring is empty.
+func (s *server) target(ring, previous Router, ends time.Time, token string) (targetResponse, bool) {
+	replicas := ring.Owners(token, s.replicationFactor)
+	if len(replicas) == 0 {
+		return targetResponse{}, false
+	}
+
+	target := targetResponse{Host: replicas[0].Name}
+	for _, d := range replicas {
+		target.Replicas = append(target.Replicas, d.Name)
+	}
+	if routed := ring.GetN(token, s.replicationFactor); !sameDestinations(routed, replicas) {
+		for _, d := range routed {
+			target.Failover = append(target.Failover, d.Name)
+		}
+	}
+	if previous != nil {
+		for _, d := range previous.Owners(token, s.replicationFactor) {
+			target.Previous = append(target.Previous, d.Name)
+		}
+		target.TransitionEnds = &ends
+	}
+	return target, true
+}
+
+func sameDestinations(a, b []*destination) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// "paused", "unavailable" while its circuit breaker is open, "overloaded"
+// while backpressure is engaged, or "healthy".
+func (s *server) destinationHealth(d *destination) string {
+	switch {
+	case d.Paused():
+		return "paused"
+	case !d.Available():
+		return "unavailable"
+	case s.backpressure != nil && s.backpressure.overloaded(d):
+		return "overloaded"
+	}
+	return "healthy"
+}
+
 // GET /target/<opaque id>
 func (s *server) serveTarget(w http.ResponseWriter, r *http.Request) {
 	parts := strings.SplitN(r.URL.Path, "/", 3)
@@ -15,17 +103,73 @@ func (s *server) serveTarget(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id := parts[2]
+	previous, ends := s.routes.Transition()
+	target, ok := s.target(s.routes.Ring(), previous, ends, parts[2])
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		internalServerErrorCounter.Inc(1)
+		return
+	}
+
+	writeTargetJSON(w, target)
+}
+
+// POST /target with {"tokens": [...]}
+//
+// Looks up many tokens against the same ring, returning each token's
+// replicas along with the ring version, database name and the health of every
+// host in the response.
+func (s *server) serveTargets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		wrongMethodErrorCounter.Inc(1)
+		return
+	}
+
+	var req targetsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		badRequestCounter.Inc(1)
+		return
+	}
+	if len(req.Tokens) > maxTargetTokens {
+		http.Error(w, fmt.Sprintf("at most %d tokens can be looked up at once", maxTargetTokens), http.StatusBadRequest)
+		badRequestCounter.Inc(1)
+		return
+	}
+
+	ring := s.routes.Ring()
+	previous, ends := s.routes.Transition()
+	resp := targetsResponse{
+		Version:  ring.Version(),
+		Database: os.Getenv("INFLUXDB_NAME"),
+		Targets:  make(map[string]targetResponse, len(req.Tokens)),
+		Health:   make(map[string]string),
+	}
+	for _, token := range req.Tokens {
+		target, ok := s.target(ring, previous, ends, token)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			internalServerErrorCounter.Inc(1)
+			return
+		}
+		resp.Targets[token] = target
+	}
+	for _, d := range ring.Destinations() {
+		resp.Health[d.Name] = s.destinationHealth(d)
+	}
 
-	destination := s.hashRing.Get(id)
+	writeTargetJSON(w, resp)
+}
 
-	if destination == nil {
+func writeTargetJSON(w http.ResponseWriter, v interface{}) {
+	response, err := json.Marshal(v)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		internalServerErrorCounter.Inc(1)
 		return
 	}
 
-	response := []byte("{ \"host\": \"" + destination.Name + "\" }")
 	headers := w.Header()
 	headers.Set("Content-Length", fmt.Sprintf("%d", len(response)))
 	headers.Set("Content-Type", "application/json")
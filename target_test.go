@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
 )
@@ -14,7 +17,7 @@ func TestTargetWithMultipleAuth(t *testing.T) {
 	ba := auth.NewBasicAuth()
 	ba.AddPrincipal("user1", "pass1")
 	ba.AddPrincipal("user2", "pass2")
-	server := newServer(&http.Server{}, ba, newHashRing(1, nil))
+	server := newServer(&http.Server{}, ba, ba, newRoutes(newTestClientFunc))
 
 	recorder := httptest.NewRecorder()
 
@@ -37,7 +40,7 @@ func TestTargetWithMultiplePasswords(t *testing.T) {
 	ba := auth.NewBasicAuth()
 	ba.AddPrincipal("user", "pass1")
 	ba.AddPrincipal("user", "pass2")
-	server := newServer(&http.Server{}, ba, newHashRing(1, nil))
+	server := newServer(&http.Server{}, ba, ba, newRoutes(newTestClientFunc))
 
 	recorder := httptest.NewRecorder()
 
@@ -59,7 +62,7 @@ func TestTargetWithMultiplePasswords(t *testing.T) {
 func TestTargetWithoutAuth(t *testing.T) {
 	ba := auth.NewBasicAuth()
 	ba.AddPrincipal("foo", "foo")
-	server := newServer(&http.Server{}, ba, nil)
+	server := newServer(&http.Server{}, ba, ba, nil)
 
 	recorder := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/target/foo", bytes.NewReader([]byte("")))
@@ -74,11 +77,37 @@ func TestTargetWithoutAuth(t *testing.T) {
 	}
 }
 
+func TestAdminRoutesNeedAdminAuth(t *testing.T) {
+	drainAuth, adminAuth := auth.NewBasicAuth(), auth.NewBasicAuth()
+	drainAuth.AddPrincipal("drain", "pass")
+	adminAuth.AddPrincipal("admin", "secret")
+	routes := createMessageRoutes("null", newTestClientFunc)
+	server := newServer(&http.Server{}, drainAuth, adminAuth, routes)
+
+	for _, path := range []string{"/admin/ring", "/admin/destinations", "/admin/ratelimits", "/admin/loglevel", "/metrics", "/tap/t.abc"} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.SetBasicAuth("drain", "pass")
+		server.http.Handler.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected drain credentials to be refused, got %d", path, recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/ring", nil)
+	req.SetBasicAuth("admin", "secret")
+	server.http.Handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected admin credentials to be accepted, got %d", recorder.Code)
+	}
+}
+
 func TestTargetWithoutId(t *testing.T) {
 	//Setup
 	ba := auth.NewBasicAuth()
 	ba.AddPrincipal("foo", "foo")
-	server := newServer(&http.Server{}, ba, nil)
+	server := newServer(&http.Server{}, ba, ba, nil)
 
 	recorder := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/target/", bytes.NewReader([]byte("")))
@@ -95,7 +124,7 @@ func TestTargetWithoutId(t *testing.T) {
 }
 
 func TestTargetWithoutRing(t *testing.T) {
-	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, newHashRing(1, nil))
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, newRoutes(newTestClientFunc))
 
 	recorder := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/target/foo", bytes.NewReader([]byte("")))
@@ -112,8 +141,7 @@ func TestTargetWithoutRing(t *testing.T) {
 }
 
 func TestTarget(t *testing.T) {
-	hashRing, _, _ := createMessageRoutes("null", newTestClientFunc)
-	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, hashRing)
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, createMessageRoutes("null", newTestClientFunc))
 
 	recorder := httptest.NewRecorder()
 	req, err := http.NewRequest("GET", "/target/foo", bytes.NewReader([]byte("")))
@@ -130,7 +158,73 @@ func TestTarget(t *testing.T) {
 
 	body := recorder.Body.String()
 
-	if body != "{ \"host\": \"null\" }" {
+	if body != `{"host":"null","replicas":["null"]}` {
 		t.Fatal("Wrong Body: ", body)
 	}
 }
+
+func TestTargets(t *testing.T) {
+	os.Setenv("INFLUXDB_NAME", "ingress")
+	defer os.Unsetenv("INFLUXDB_NAME")
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, createMessageRoutes("null", newTestClientFunc))
+
+	testCases := []struct {
+		method, body string
+		status       int
+		response     string
+	}{
+		{"POST", `{"tokens": ["foo", "bar"]}`, http.StatusOK,
+			`{"version":1,"database":"ingress","targets":{"bar":{"host":"null","replicas":["null"]},"foo":{"host":"null","replicas":["null"]}},"health":{"null":"healthy"}}`},
+		{"POST", `{"tokens": []}`, http.StatusOK, `{"version":1,"database":"ingress","targets":{},"health":{"null":"healthy"}}`},
+		{"POST", `{"tokens": `, http.StatusBadRequest, ""},
+		{"POST", `{"tokens": ["` + strings.Repeat(`t", "`, maxTargetTokens) + `t"]}`, http.StatusBadRequest, ""},
+		{"GET", "", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, tc := range testCases {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest(tc.method, "/target", bytes.NewReader([]byte(tc.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server.http.Handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != tc.status {
+			t.Errorf("%s %.40s: expected %d, got %d", tc.method, tc.body, tc.status, recorder.Code)
+		}
+		if tc.response != "" && recorder.Body.String() != tc.response {
+			t.Errorf("%s %.40s: expected %s, got %s", tc.method, tc.body, tc.response, recorder.Body.String())
+		}
+	}
+}
+
+func TestTargetFailover(t *testing.T) {
+	routes := createMessageRoutes("a,b", newTestClientFunc)
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, routes)
+
+	get := func() targetResponse {
+		target, ok := server.target(routes.Ring(), nil, time.Time{}, "foo")
+		if !ok {
+			t.Fatal("Expected a target")
+		}
+		return target
+	}
+
+	before := get()
+	if before.Failover != nil {
+		t.Fatalf("Expected no failover while every host is healthy, got %v", before.Failover)
+	}
+
+	// Open the primary's breaker: the replicas stay put, and the host points
+	// fail over to is reported separately.
+	primary := routes.Ring().Owners("foo", 1)[0]
+	primary.breaker = newCircuitBreaker(primary.Name, 0.5, 1, time.Minute, time.Minute, nil)
+	primary.breaker.Failure()
+	defer func() { primary.breaker = nil }()
+
+	after := get()
+	if after.Host != before.Host || len(after.Failover) != 1 || after.Failover[0] == before.Host {
+		t.Errorf("Expected %s to stay the host and fail over elsewhere, got %+v", before.Host, after)
+	}
+}
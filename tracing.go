@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	metrics "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/rcrowley/go-metrics"
+)
+
+const (
+	traceBatchSize      = 512
+	traceExportInterval = 5 * time.Second
+	traceQueueSize      = 4096
+	maxSpanEvents       = 128
+	maxSpanLinks        = 128
+
+	spanKindServer = 2 // SPAN_KIND_SERVER
+	spanKindClient = 3 // SPAN_KIND_CLIENT
+
+	spanStatusError = 2 // STATUS_CODE_ERROR
+)
+
+var (
+	spansExportedCounter = metrics.GetOrRegisterCounter("lumbermill.tracing.spans.exported", metrics.DefaultRegistry)
+	spansDroppedCounter  = metrics.GetOrRegisterCounter("lumbermill.tracing.spans.dropped", metrics.DefaultRegistry)
+
+	// Nil, tracing nothing, unless an OTLP endpoint and sample rate are set.
+	tracing = newTracerFromEnv()
+)
+
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+type spanEvent struct {
+	at         time.Time
+	name       string
+	attributes []otlpAttribute
+}
+
+// A span being recorded. Spans are only touched by the goroutine that started
+// them until End. All methods are no-ops on nil spans, which are what
+// unsampled requests get.
+type span struct {
+	tracer        *tracer
+	context       spanContext
+	name          string
+	kind          int
+	start, end    time.Time
+	attributes    []otlpAttribute
+	counts        map[string]int64 // Exported as attributes
+	events        []spanEvent
+	droppedEvents int
+	links         []spanContext
+	droppedLinks  int
+	statusMessage string // Non empty if the span failed
+}
+
+func (s *span) Context() *spanContext {
+	if s == nil {
+		return nil
+	}
+	return &s.context
+}
+
+// Sets key value attributes.
+func (s *span) SetAttributes(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.attributes = append(s.attributes, otlpAttributes(kv)...)
+}
+
+// Adds n to a count, exported as the lumbermill.<name> attribute, for things
+// too frequent to record as events.
+func (s *span) Count(name string, n int64) {
+	if s == nil {
+		return
+	}
+	if s.counts == nil {
+		s.counts = make(map[string]int64)
+	}
+	s.counts[name] += n
+}
+
+// Records an event, with key value attributes.
+func (s *span) AddEvent(name string, kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	if len(s.events) >= maxSpanEvents {
+		s.droppedEvents++
+		return
+	}
+	s.events = append(s.events, spanEvent{at: time.Now(), name: name, attributes: otlpAttributes(kv)})
+}
+
+// Marks the span as failed.
+func (s *span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	s.statusMessage = err.Error()
+}
+
+// Finishes the span and queues it for export, dropping it if the queue is
+// full.
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+		spansDroppedCounter.Inc(1)
+	}
+}
+
+func otlpAttributes(kv []interface{}) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		if key, ok := kv[i].(string); ok {
+			attributes = append(attributes, otlpAttributeOf(key, kv[i+1]))
+		}
+	}
+	return attributes
+}
+
+// The distinct drain batches a delivery's points came from. Points from the
+// same batch share a span context.
+type spanLinks struct {
+	seen     map[*spanContext]bool
+	contexts []spanContext
+}
+
+func (l *spanLinks) add(sc *spanContext) {
+	if sc == nil || l.seen[sc] {
+		return
+	}
+	if l.seen == nil {
+		l.seen = make(map[*spanContext]bool)
+	}
+	l.seen[sc] = true
+	l.contexts = append(l.contexts, *sc)
+}
+
+// Head samples drain requests per token, and exports their spans, and those
+// of the writes their points end up in, over OTLP.
+type tracer struct {
+	exporter    *otlpExporter
+	resource    otlpResource
+	defaultRate float64
+	rates       map[string]float64
+	spans       chan *span
+}
+
+func newTracer(exporter *otlpExporter, tags map[string]string, defaultRate float64, rates map[string]float64) *tracer {
+	return &tracer{
+		exporter:    exporter,
+		resource:    otlpResourceFor(tags),
+		defaultRate: defaultRate,
+		rates:       rates,
+		spans:       make(chan *span, traceQueueSize),
+	}
+}
+
+// Configures tracing from TRACE_SAMPLE_RATE (0-1), TRACE_SAMPLE_RATES
+// ("token1:1|token2:0.1"), the OTLP exporter's environment and the common
+// tags. Returns nil if nothing would be traced.
+func newTracerFromEnv() *tracer {
+	exporter := newOTLPExporterFromEnv("traces")
+	if exporter == nil {
+		return nil
+	}
+
+	defaultRate := envFloat("TRACE_SAMPLE_RATE", 0)
+	rates := make(map[string]float64)
+	for token, v := range parseKeyValueList(os.Getenv("TRACE_SAMPLE_RATES")) {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			logger.Warn("tracing", "err", err, "token", token, "rate", v)
+			continue
+		}
+		rates[token] = rate
+	}
+
+	if defaultRate <= 0 && len(rates) == 0 {
+		return nil
+	}
+	return newTracer(exporter, commonTagsFromEnv(), defaultRate, rates)
+}
+
+func (t *tracer) rate(token string) float64 {
+	if rate, ok := t.rates[token]; ok {
+		return rate
+	}
+	return t.defaultRate
+}
+
+// Starts a root span for the token's request, or returns nil if the request
+// isn't sampled.
+func (t *tracer) Start(name, token string) *span {
+	if t == nil {
+		return nil
+	}
+	if rate := t.rate(token); rate <= 0 || (rate < 1 && mathrand.Float64() >= rate) {
+		return nil
+	}
+
+	s := t.newSpan(name, spanKindServer)
+	rand.Read(s.context.TraceID[:])
+	return s
+}
+
+// Starts a root span linked to the spans of the requests it continues the
+// work of. Work for unsampled requests alone isn't traced.
+func (t *tracer) StartLinked(name string, links []spanContext) *span {
+	if t == nil || len(links) == 0 {
+		return nil
+	}
+
+	s := t.newSpan(name, spanKindClient)
+	rand.Read(s.context.TraceID[:])
+	if len(links) > maxSpanLinks {
+		s.droppedLinks = len(links) - maxSpanLinks
+		links = links[:maxSpanLinks]
+	}
+	s.links = links
+	return s
+}
+
+func (t *tracer) newSpan(name string, kind int) *span {
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.context.SpanID[:])
+	return s
+}
+
+// Exports spans in batches, as they fill up or every traceExportInterval.
+func (t *tracer) Run() {
+	if t == nil {
+		return
+	}
+
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := t.export(batch); err != nil {
+			spansDroppedCounter.Inc(int64(len(batch)))
+			logger.Warn("tracing", "spans", len(batch), "err", err)
+		} else {
+			spansExportedCounter.Inc(int64(len(batch)))
+		}
+		batch = nil
+	}
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID            string          `json:"traceId"` // Hex in OTLP JSON
+	SpanID             string          `json:"spanId"`
+	Name               string          `json:"name"`
+	Kind               int             `json:"kind"`
+	StartTimeUnixNano  string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano    string          `json:"endTimeUnixNano"`
+	Attributes         []otlpAttribute `json:"attributes,omitempty"`
+	Events             []otlpEvent     `json:"events,omitempty"`
+	DroppedEventsCount int             `json:"droppedEventsCount,omitempty"`
+	Links              []otlpLink      `json:"links,omitempty"`
+	DroppedLinksCount  int             `json:"droppedLinksCount,omitempty"`
+	Status             otlpStatus      `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (t *tracer) export(spans []*span) error {
+	exported := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		exported = append(exported, s.otlp())
+	}
+
+	return t.exporter.post(otlpTracesRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   t.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "lumbermill"}, Spans: exported}},
+	}}})
+}
+
+func (s *span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceID:            hex.EncodeToString(s.context.TraceID[:]),
+		SpanID:             hex.EncodeToString(s.context.SpanID[:]),
+		Name:               s.name,
+		Kind:               s.kind,
+		StartTimeUnixNano:  otlpTime(s.start),
+		EndTimeUnixNano:    otlpTime(s.end),
+		Attributes:         s.attributes,
+		DroppedEventsCount: s.droppedEvents,
+		DroppedLinksCount:  s.droppedLinks,
+	}
+
+	names := make([]string, 0, len(s.counts))
+	for name := range s.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o.Attributes = append(o.Attributes, otlpInt("lumbermill."+name, s.counts[name]))
+	}
+
+	for _, e := range s.events {
+		o.Events = append(o.Events, otlpEvent{TimeUnixNano: otlpTime(e.at), Name: e.name, Attributes: e.attributes})
+	}
+	for _, l := range s.links {
+		o.Links = append(o.Links, otlpLink{TraceID: hex.EncodeToString(l.TraceID[:]), SpanID: hex.EncodeToString(l.SpanID[:])})
+	}
+	if s.statusMessage != "" {
+		o.Status = otlpStatus{Code: spanStatusError, Message: s.statusMessage}
+	}
+	return o
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/heroku/authenticater"
+	influx "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/influxdb/influxdb-go"
+)
+
+// Swaps in a tracer sampling every request from token, returning a func to
+// restore the previous one.
+func setupTestTracer(token string) (*tracer, func()) {
+	previous := tracing
+	tracing = newTracer(nil, map[string]string{"dyno": "web.1"}, 0, map[string]float64{token: 1})
+	return tracing, func() { tracing = previous }
+}
+
+func TestTracerSampling(t *testing.T) {
+	tr := newTracer(nil, nil, 0, map[string]float64{"t.traced": 1})
+	if tr.Start("drain", "t.traced") == nil {
+		t.Error("Expected a token sampled at 1 to be traced")
+	}
+	if tr.Start("drain", "t.other") != nil {
+		t.Error("Expected a token sampled at the default of 0 not to be traced")
+	}
+	if tr.StartLinked("influxdb.write", nil) != nil {
+		t.Error("Expected writes without sampled points not to be traced")
+	}
+
+	// Nil tracers and spans trace nothing.
+	var nilTracer *tracer
+	s := nilTracer.Start("drain", "t.traced")
+	s.AddEvent("event")
+	s.Count("points", 1)
+	s.End()
+	if s.Context() != nil {
+		t.Error("Expected no span from a nil tracer")
+	}
+}
+
+func TestDrainSpan(t *testing.T) {
+	tr, restore := setupTestTracer("t.abc")
+	defer restore()
+
+	server := newServer(&http.Server{}, auth.AnyOrNoAuth{}, auth.AnyOrNoAuth{}, createMessageRoutes("null", newTestClientFunc))
+	lines := []string{
+		`<158>1 2014-07-02T00:00:00+00:00 host heroku router - at=info method=GET path="/" host=a request_id=1 fwd="1" dyno=web.1 connect=1ms service=10ms status=200 bytes=10`,
+		`<158>1 not-a-time host heroku router - at=info status=200`,
+		`<158>1 2014-07-02T00:00:00+00:00 host app web.1 - hello`,
+	}
+	var body string
+	for _, line := range lines {
+		body += fmt.Sprintf("%d %s", len(line), line)
+	}
+
+	req, _ := http.NewRequest("POST", "/drain", strings.NewReader(body))
+	req.Header.Set("Logplex-Drain-Token", "t.abc")
+	req.Header.Set("Logplex-Frame-Id", "frame1")
+	req.Header.Set("Logplex-Msg-Count", "3")
+	server.http.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var s *span
+	select {
+	case s = <-tr.spans:
+	default:
+		t.Fatal("Expected the drain request to be traced")
+	}
+
+	o := s.otlp()
+	attributes := make(map[string]string)
+	for _, a := range o.Attributes {
+		switch {
+		case a.Value.StringValue != nil:
+			attributes[a.Key] = *a.Value.StringValue
+		case a.Value.IntValue != nil:
+			attributes[a.Key] = *a.Value.IntValue
+		}
+	}
+	expected := map[string]string{
+		"lumbermill.token":         "t.abc",
+		"logplex.frame_id":         "frame1",
+		"logplex.msg_count":        "3",
+		"lumbermill.lines":         "3",
+		"lumbermill.points.posted": "1",
+		"lumbermill.lines.unknown": "1",
+	}
+	for k, v := range expected {
+		if attributes[k] != v {
+			t.Errorf("Expected %s=%s, got %q", k, v, attributes[k])
+		}
+	}
+	if len(o.Events) != 1 || o.Events[0].Name != "time-parse-error" {
+		t.Errorf("Expected a time parse error event, got %+v", o.Events)
+	}
+
+	// Requests from other tokens aren't sampled.
+	req, _ = http.NewRequest("POST", "/drain", strings.NewReader(body))
+	req.Header.Set("Logplex-Drain-Token", "t.other")
+	server.http.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	if len(tr.spans) != 0 {
+		t.Error("Expected t.other not to be traced")
+	}
+}
+
+func TestPosterWriteSpan(t *testing.T) {
+	tr, restore := setupTestTracer("t.abc")
+	defer restore()
+
+	handler, _ := newStatusSequenceHandler(503)
+	p, cleanup := newTestPoster(t, handler)
+	defer cleanup()
+
+	drain := tr.Start("drain", "t.abc")
+	var links spanLinks
+	links.add(drain.Context())
+	links.add(drain.Context())
+	links.add(nil)
+	p.deliver(map[string]*influx.Series{"router.foo": testSeries(4)[0]}, links.contexts)
+
+	var s *span
+	select {
+	case s = <-tr.spans:
+	default:
+		t.Fatal("Expected the write to be traced")
+	}
+
+	o := s.otlp()
+	if o.Name != "influxdb.write" || len(o.Links) != 1 || o.Links[0].SpanID != hex.EncodeToString(drain.context.SpanID[:]) {
+		t.Errorf("Expected a write linked to the drain request, got %+v", o)
+	}
+	if len(o.Events) != 1 || o.Events[0].Name != "write-error" || o.Status.Code != 0 {
+		t.Errorf("Expected a retried write error, got %+v", o)
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	var body otlpTracesRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer collector.Close()
+
+	exporter := &otlpExporter{url: collector.URL + "/v1/traces", client: &http.Client{Timeout: time.Second}}
+	tr := newTracer(exporter, map[string]string{"dyno": "web.1"}, 1, nil)
+	s := tr.Start("drain", "t.abc")
+	s.SetError(fmt.Errorf("boom"))
+	s.End()
+
+	if err := tr.export([]*span{<-tr.spans}); err != nil {
+		t.Fatal(err)
+	}
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].TraceID != hex.EncodeToString(s.context.TraceID[:]) || spans[0].Status.Message != "boom" {
+		t.Errorf("Unexpected spans %+v", spans)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+
+	influx "github.com/heroku/lumbermill/Godeps/_workspace/src/github.com/influxdb/influxdb-go"
+)
+
+// How a failed write to InfluxDB should be handled
+type writeErrorClass int
+
+const (
+	writeRetryable writeErrorClass = iota // Timeouts, refused connections, 5xx and 429
+	writePermanent                        // Other 4xx: schema or auth errors that will fail again
+	writeTooLarge                         // 413: split the batch and try the halves
+	numWriteErrorClasses
+)
+
+var (
+	writeErrorClassNames = []string{"retryable", "permanent", "too_large"}
+
+	// The influxdb-go client reports non 2xx responses as "Server returned (<status>): <body>"
+	serverReturnedRegexp = regexp.MustCompile(`^Server returned \((\d{3})\)`)
+)
+
+func (c writeErrorClass) Name() string {
+	return writeErrorClassNames[c]
+}
+
+// Classifies an error returned by the InfluxDB client
+func classifyWriteError(err error) writeErrorClass {
+	if m := serverReturnedRegexp.FindStringSubmatch(err.Error()); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		switch {
+		case status == 413:
+			return writeTooLarge
+		case status == 429, status >= 500:
+			return writeRetryable
+		case status >= 400:
+			return writePermanent
+		}
+		return writeRetryable
+	}
+
+	// Timeouts, refused connections and resets all come from the HTTP client.
+	if _, ok := err.(*url.Error); ok {
+		return writeRetryable
+	}
+	return writePermanent
+}
+
+// Splits a batch in two, by series if there are several, otherwise by points.
+// Returns false if the batch is a single point.
+func splitSeries(series []*influx.Series) ([]*influx.Series, []*influx.Series, bool) {
+	if len(series) > 1 {
+		return series[:len(series)/2], series[len(series)/2:], true
+	}
+	if len(series) == 0 || len(series[0].Points) < 2 {
+		return nil, nil, false
+	}
+
+	s := series[0]
+	half := len(s.Points) / 2
+	a := &influx.Series{Name: s.Name, Columns: s.Columns, Points: s.Points[:half]}
+	b := &influx.Series{Name: s.Name, Columns: s.Columns, Points: s.Points[half:]}
+	return []*influx.Series{a}, []*influx.Series{b}, true
+}